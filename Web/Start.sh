@@ -1,6 +1,16 @@
 #!/bin/bash
 echo you env is $1
 
+#编译沙箱需要在容器中创建user namespace并挂载目录，seccomp.json在docker默认配置的基础上只允许带CLONE_NEWUSER的clone/unshare
+#以及mount、umount2和pivot_root（没有CAP_SYS_ADMIN时只能在新的user namespace中使用），
+#apparmor.profile在docker-default的基础上允许mount，宿主机没有AppArmor时不需要
+SECURITY_OPTS="--security-opt seccomp=seccomp.json"
+if command -v apparmor_parser >/dev/null 2>&1
+then
+    apparmor_parser -r -W apparmor.profile
+    SECURITY_OPTS="$SECURITY_OPTS --security-opt apparmor=verify-contract"
+fi
+
 if [ $1 == "TEST" ]
 then
 
@@ -12,7 +22,7 @@ then
 
     docker build -t verify_testnet:v1 .
 
-    docker run --env RUNTIME="testnet" -itd --name verifyContract_testnet -p 3026:1927 verify_testnet:v1
+    docker run $SECURITY_OPTS --env RUNTIME="testnet" -itd --name verifyContract_testnet -p 3026:1927 verify_testnet:v1
 fi
 
 if [ $1 == "STAGING" ]
@@ -26,7 +36,7 @@ then
 
     docker build -t verify_mainnet:v1 .
 
-    docker run --env RUNTIME="mainnet" -itd --name verifyContract_mainnet -p 3027:1927 verify_mainnet:v1
+    docker run $SECURITY_OPTS --env RUNTIME="mainnet" -itd --name verifyContract_mainnet -p 3027:1927 verify_mainnet:v1
 fi
 
 if [ $1 == "TESTMAGNET" ]
@@ -40,5 +50,5 @@ then
 
     docker build -t verify_testmagnet:v1 .
 
-    docker run --env RUNTIME="testmagnet" -itd --name verifyContract_testmagnet -p 3028:1927 verify_testmagnet:v1
+    docker run $SECURITY_OPTS --env RUNTIME="testmagnet" -itd --name verifyContract_testmagnet -p 3028:1927 verify_testmagnet:v1
 fi
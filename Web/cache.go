@@ -0,0 +1,308 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"github.com/prometheus/client_golang/prometheus"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// 定义编译缓存的key包含的内容：规范化的源码（相对路径和文件hash，按路径排序，不包含编译生成的文件），
+// 编译器以及影响编译结果的选项
+type buildCacheKey struct {
+	Compiler        string
+	Name            string
+	Version         string
+	Command         []string
+	Toolchain       string
+	Options         []compileOption
+	ContractConfig  string
+	EntryFile       string
+	ContractProject string
+	JavaPackage     string
+	Sources         []string
+}
+
+var (
+	buildCacheHits = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "build_cache_hits_total",
+		Help: "Number of compilations served from the build cache.",
+	}, []string{"compiler"})
+	buildCacheMisses = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "build_cache_misses_total",
+		Help: "Number of compilations that weren't found in the build cache.",
+	}, []string{"compiler"})
+	buildCacheSize = prometheus.NewGauge(prometheus.GaugeOpts{
+		Name: "build_cache_size_bytes",
+		Help: "Total size of the build cache after the last eviction.",
+	})
+)
+
+func init() {
+	prometheus.MustRegister(buildCacheHits, buildCacheMisses, buildCacheSize)
+}
+
+// 写入和清理缓存时只允许一个任务操作
+var buildCacheLock sync.Mutex
+
+// 编译缓存的目录，可以通过BUILD_CACHE_DIR环境变量指定
+func buildCacheDir() string {
+	if d := os.Getenv("BUILD_CACHE_DIR"); d != "" {
+		return d
+	}
+	return "/go/application/build-cache"
+}
+
+// BUILD_CACHE=off时不使用编译缓存
+func buildCacheEnabled() bool {
+	return os.Getenv("BUILD_CACHE") != "off"
+}
+
+// 编译缓存的最大大小，可以通过BUILD_CACHE_MB环境变量指定，超过时删除最久没有使用的编译结果
+func buildCacheMaxBytes() int64 {
+	return int64(getEnvInt("BUILD_CACHE_MB", 2048)) << 20
+}
+
+// 计算编译缓存的key，需要在BuildCommand之后调用，这时m中已经填入了默认的项目文件、入口文件和配置文件。
+// 不使用缓存或者计算失败时返回空
+func buildCacheHash(c Compiler, pathFile string, m map[string]string) string {
+	if !buildCacheEnabled() {
+		return ""
+	}
+	options, err := c.ParseOptions(m)
+	if err != nil {
+		return ""
+	}
+	cfg := c.Config()
+	key := buildCacheKey{
+		Compiler:        c.ID(),
+		Name:            c.Identity().Name,
+		Version:         c.Identity().Version,
+		Command:         cfg.Command,
+		Options:         options,
+		ContractConfig:  getContractConfig(m),
+		EntryFile:       getEntryFile(m),
+		ContractProject: getContractProject(m),
+		JavaPackage:     getJavaPackage(m),
+	}
+	if cfg.Toolchain != nil {
+		key.Toolchain = cfg.Toolchain.Sha256
+	}
+	files, err := walkSources(pathFile)
+	if err != nil {
+		fmt.Println("Build cache:", err)
+		return ""
+	}
+	sort.Strings(files)
+	for _, f := range files {
+		if isBuildOutput(f) {
+			continue
+		}
+		sum, err := fileSha256(filepath.Join(pathFile, f))
+		if err != nil {
+			fmt.Println("Build cache:", err)
+			return ""
+		}
+		key.Sources = append(key.Sources, f+" "+sum)
+	}
+	data, err := json.Marshal(key)
+	if err != nil {
+		return ""
+	}
+	h := sha256.Sum256(data)
+	return hex.EncodeToString(h[:])
+}
+
+func buildCacheEntry(hash string) string {
+	return filepath.Join(buildCacheDir(), hash[:2], hash)
+}
+
+// 把缓存的编译结果复制到上传目录，没有缓存时返回false
+func restoreBuild(c Compiler, hash string, pathFile string) bool {
+	if hash == "" {
+		return false
+	}
+	entry := buildCacheEntry(hash)
+	files, err := walkFiles(entry)
+	if err != nil || len(files) == 0 {
+		buildCacheMisses.WithLabelValues(c.ID()).Inc()
+		return false
+	}
+	for _, f := range files {
+		err = copyFile(filepath.Join(entry, f), filepath.Join(pathFile, f))
+		if err != nil {
+			fmt.Println("Build cache:", err)
+			buildCacheMisses.WithLabelValues(c.ID()).Inc()
+			return false
+		}
+	}
+	//记录最近一次使用的时间，清理时保留最近使用的编译结果
+	now := time.Now()
+	os.Chtimes(entry, now, now)
+	buildCacheHits.WithLabelValues(c.ID()).Inc()
+	fmt.Println("Build cache: hit " + hash)
+	return true
+}
+
+// 把.nef、.manifest.json、调试信息以及编译日志保存到缓存中，编译没有生成.nef文件时不保存
+func storeBuild(c Compiler, hash string, pathFile string, m map[string]string) {
+	if hash == "" {
+		return
+	}
+	files := buildOutputs(c, pathFile, m)
+	if len(files) == 0 {
+		return
+	}
+	buildCacheLock.Lock()
+	defer buildCacheLock.Unlock()
+	entry := buildCacheEntry(hash)
+	if _, err := os.Stat(entry); err == nil {
+		return
+	}
+	err := os.MkdirAll(filepath.Dir(entry), 0777)
+	if err != nil {
+		fmt.Println("Build cache:", err)
+		return
+	}
+	//先写入临时目录，完整之后再重命名，避免其它任务读到不完整的编译结果
+	tmp, err := ioutil.TempDir(filepath.Dir(entry), ".tmp-")
+	if err != nil {
+		fmt.Println("Build cache:", err)
+		return
+	}
+	for _, f := range files {
+		err = copyFile(filepath.Join(pathFile, f), filepath.Join(tmp, f))
+		if err != nil {
+			break
+		}
+	}
+	if err == nil {
+		os.Chmod(tmp, 0777)
+		err = os.Rename(tmp, entry)
+	}
+	if err != nil {
+		os.RemoveAll(tmp)
+		fmt.Println("Build cache:", err)
+		return
+	}
+	fmt.Println("Build cache: stored " + hash)
+	evictBuildCache()
+}
+
+// 返回需要缓存的文件相对于上传目录的路径：输出目录中与.nef同名的编译结果以及编译日志
+func buildOutputs(c Compiler, pathFile string, m map[string]string) []string {
+	dir, file := c.OutputPath(pathFile, m)
+	if _, err := os.Stat(dir + file + ".nef"); err != nil || file == "" {
+		return nil
+	}
+	rel, err := filepath.Rel(pathFile, dir)
+	if err != nil || strings.HasPrefix(rel, "..") {
+		return nil
+	}
+	names, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return nil
+	}
+	files := []string{}
+	for _, n := range names {
+		if !n.IsDir() && strings.HasPrefix(n.Name(), file+".") && isBuildOutput(n.Name()) {
+			files = append(files, path.Join(filepath.ToSlash(rel), n.Name()))
+		}
+	}
+	logs, _ := walkFiles(filepath.Join(pathFile, compileLogDir))
+	for _, f := range logs {
+		files = append(files, path.Join(compileLogDir, f))
+	}
+	return files
+}
+
+// 缓存超过最大大小时，按最近使用的时间从旧到新删除编译结果，调用时需要持有buildCacheLock
+func evictBuildCache() {
+	type cacheEntry struct {
+		dir  string
+		size int64
+		used time.Time
+	}
+	entries := []cacheEntry{}
+	total := int64(0)
+	prefixes, _ := ioutil.ReadDir(buildCacheDir())
+	for _, p := range prefixes {
+		if !p.IsDir() {
+			continue
+		}
+		names, _ := ioutil.ReadDir(filepath.Join(buildCacheDir(), p.Name()))
+		for _, n := range names {
+			if !n.IsDir() || strings.HasPrefix(n.Name(), ".tmp-") {
+				continue
+			}
+			e := cacheEntry{dir: filepath.Join(buildCacheDir(), p.Name(), n.Name()), used: n.ModTime()}
+			filepath.Walk(e.dir, func(p string, info os.FileInfo, err error) error {
+				if err == nil && !info.IsDir() {
+					e.size += info.Size()
+				}
+				return nil
+			})
+			entries = append(entries, e)
+			total += e.size
+		}
+	}
+	sort.Slice(entries, func(i, j int) bool {
+		return entries[i].used.Before(entries[j].used)
+	})
+	max := buildCacheMaxBytes()
+	for _, e := range entries {
+		if total <= max {
+			break
+		}
+		if err := os.RemoveAll(e.dir); err != nil {
+			fmt.Println("Build cache:", err)
+			continue
+		}
+		fmt.Println("Build cache: evicted " + filepath.Base(e.dir))
+		//前缀目录为空时一起删除
+		os.Remove(filepath.Dir(e.dir))
+		total -= e.size
+	}
+	buildCacheSize.Set(float64(total))
+}
+
+// 返回目录中所有文件相对于该目录的路径
+func walkFiles(dir string) ([]string, error) {
+	files := []string{}
+	err := filepath.Walk(dir, func(p string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if info.IsDir() {
+			return nil
+		}
+		rel, err := filepath.Rel(dir, p)
+		if err != nil {
+			return err
+		}
+		files = append(files, filepath.ToSlash(rel))
+		return nil
+	})
+	return files, err
+}
+
+func copyFile(src string, dst string) error {
+	data, err := ioutil.ReadFile(src)
+	if err != nil {
+		return err
+	}
+	err = os.MkdirAll(filepath.Dir(dst), 0777)
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(dst, data, 0666)
+}
@@ -0,0 +1,551 @@
+package main
+
+import (
+	"context"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"gopkg.in/yaml.v3"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+)
+
+// 定义一个编译器，新的编译器版本只需要在compilers.yml中增加配置
+type Compiler interface {
+	// 上传表单中Version字段对应的取值，例如neo3-boa 0.11.4
+	ID() string
+	// 编译器名称和版本，与链上nef.compiler字段解析得到的结果对应
+	Identity() compilerIdentity
+	// 源代码语言，csharp、python、go或java
+	Language() string
+	// 搜索模式下尝试的编译选项组合，即上传表单中CompileCommand字段的常用取值
+	Options() []string
+	// 按编译选项的schema解析并校验用户指定的编译选项
+	ParseOptions(m map[string]string) ([]compileOption, error)
+	// 生成编译命令
+	BuildCommand(pathFile string, folderName string, m map[string]string) (*exec.Cmd, error)
+	// 返回编译生成的.nef文件所在的目录以及文件名（不含后缀）
+	OutputPath(pathFile string, m map[string]string) (string, string)
+	// 从编译输出中解析出错误和警告
+	Diagnostics(pathFile string, m map[string]string, output compileOutput) []diagnostic
+	// 按需安装编译器的工具链，内置在镜像中的编译器不需要安装，ctx被取消时停止安装
+	Install(ctx context.Context) error
+	// 编译超时时间
+	Timeout() time.Duration
+	// 返回compilers.yml中的配置
+	Config() compilerConfig
+}
+
+// 定义compilers.yml中一个编译器的配置
+type compilerConfig struct {
+	ID       string   `yaml:"id"`
+	Aliases  []string `yaml:"aliases"`
+	Name     string   `yaml:"name"`
+	Version  string   `yaml:"version"`
+	Language string   `yaml:"language"`
+	Command  []string `yaml:"command"`
+	// neo-go使用的interop模块，格式为module@version
+	Interop string `yaml:"interop"`
+	// 编译选项的schema名称，对应配置文件中schemas的一项
+	Schema  string   `yaml:"schema"`
+	Options []string `yaml:"options"`
+	// 按需安装的工具链，command中的{toolchain}会被替换成工具链的安装目录
+	Toolchain *toolchainConfig `yaml:"toolchain"`
+	// 编译超时时间，例如20m，为空时使用COMPILE_TIMEOUT
+	Timeout string `yaml:"timeout"`
+	schema  []optionSchema
+	timeout time.Duration
+}
+
+// 定义编译器注册表，order保存配置文件中的顺序，aliases保存别名对应的编译器，
+// unavailable保存自检失败的编译器以及失败原因，flaky保存确定性检查中编译结果不一致的编译器
+type compilerRegistry struct {
+	order       []string
+	compilers   map[string]Compiler
+	aliases     map[string]string
+	mu          sync.RWMutex
+	unavailable map[string]string
+	flaky       map[string]string
+}
+
+// 启动时从配置文件加载的编译器注册表
+var compilers = &compilerRegistry{compilers: map[string]Compiler{}, aliases: map[string]string{}}
+
+// 读取编译器配置文件，生成编译器注册表
+func loadCompilerRegistry(file string) (*compilerRegistry, error) {
+	absPath, _ := filepath.Abs(file)
+	data, err := ioutil.ReadFile(absPath)
+	if err != nil {
+		return nil, err
+	}
+	var cfg struct {
+		Schemas   map[string][]optionSchema `yaml:"schemas"`
+		Compilers []compilerConfig          `yaml:"compilers"`
+	}
+	err = yaml.Unmarshal(data, &cfg)
+	if err != nil {
+		return nil, err
+	}
+	registry := &compilerRegistry{compilers: map[string]Compiler{}, aliases: map[string]string{}}
+	for _, c := range cfg.Compilers {
+		if c.Schema != "" {
+			schema, ok := cfg.Schemas[c.Schema]
+			if !ok {
+				return nil, errors.New("compiler " + c.Name + " " + c.Version + ": unknown option schema " + c.Schema)
+			}
+			c.schema = schema
+		}
+		compiler, err := newCompiler(c)
+		if err != nil {
+			return nil, err
+		}
+		if _, ok := registry.compilers[compiler.ID()]; ok {
+			return nil, errors.New("duplicate compiler " + compiler.ID())
+		}
+		registry.order = append(registry.order, compiler.ID())
+		registry.compilers[compiler.ID()] = compiler
+		for _, alias := range c.Aliases {
+			if _, ok := registry.aliases[alias]; ok {
+				return nil, errors.New("duplicate compiler alias " + alias)
+			}
+			registry.aliases[alias] = compiler.ID()
+		}
+	}
+	return registry, nil
+}
+
+// 根据配置中的语言生成对应的编译器
+func newCompiler(c compilerConfig) (Compiler, error) {
+	if c.Name == "" || c.Version == "" || len(c.Command) == 0 {
+		return nil, fmt.Errorf("compiler %q %q: name, version and command are required", c.Name, c.Version)
+	}
+	if c.ID == "" {
+		c.ID = c.Name + " " + c.Version
+	}
+	c.timeout = defaultCompileTimeout()
+	if c.Timeout != "" {
+		d, err := time.ParseDuration(c.Timeout)
+		if err != nil || d <= 0 {
+			return nil, errors.New("compiler " + c.ID + ": invalid timeout " + c.Timeout)
+		}
+		c.timeout = d
+	}
+	if c.Toolchain != nil {
+		//只安装hash固定的压缩包，setup只能使用压缩包中的文件，例如pip install --no-index --find-links .
+		if sum, err := hex.DecodeString(c.Toolchain.Sha256); c.Toolchain.Archive == "" || err != nil || len(sum) != 32 {
+			return nil, errors.New("compiler " + c.ID + ": toolchain archive and sha256 are required")
+		}
+		command := []string{}
+		for _, a := range c.Command {
+			command = append(command, strings.ReplaceAll(a, toolchainPlaceholder, toolchainPath(c)))
+		}
+		c.Command = command
+	}
+	base := baseCompiler{c}
+	switch c.Language {
+	case "csharp":
+		return csharpCompiler{base}, nil
+	case "python":
+		return pythonCompiler{base}, nil
+	case "go":
+		if c.Interop == "" {
+			return nil, errors.New("compiler " + c.ID + ": interop is required")
+		}
+		return goCompiler{base}, nil
+	case "java":
+		return javaCompiler{base}, nil
+	}
+	return nil, errors.New("compiler " + c.ID + ": unknown language " + c.Language)
+}
+
+// 按用户选择的版本查找编译器，找不到时返回的错误中列出所有已注册的编译器
+func (r *compilerRegistry) lookup(version string) (Compiler, error) {
+	c, ok := r.compilers[r.resolve(version)]
+	if !ok {
+		return nil, errors.New("Compiler version " + version + " doesn't exist, please choose one of: " + strings.Join(r.order, ", "))
+	}
+	if reason := r.unavailableReason(c.ID()); reason != "" {
+		return nil, errors.New("Compiler " + c.ID() + " is unavailable: " + reason)
+	}
+	return c, nil
+}
+
+// 标记编译器不可用，reason为空时恢复可用
+func (r *compilerRegistry) setUnavailable(id string, reason string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.unavailable == nil {
+		r.unavailable = map[string]string{}
+	}
+	if reason == "" {
+		delete(r.unavailable, id)
+	} else {
+		r.unavailable[id] = reason
+	}
+}
+
+// 标记编译器在不同条件下编译结果不一致，reason为空时取消标记
+func (r *compilerRegistry) setFlaky(id string, reason string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.flaky == nil {
+		r.flaky = map[string]string{}
+	}
+	if reason == "" {
+		delete(r.flaky, id)
+	} else {
+		r.flaky[id] = reason
+	}
+}
+
+// 返回编译器编译结果不一致的说明，没有标记时返回空
+func (r *compilerRegistry) flakyReason(id string) string {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	return r.flaky[id]
+}
+
+// 返回编译器不可用的原因，可用时返回空
+func (r *compilerRegistry) unavailableReason(id string) string {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	return r.unavailable[id]
+}
+
+// 把别名换算成编译器的ID，不是别名时原样返回
+func (r *compilerRegistry) resolve(version string) string {
+	version = strings.TrimSpace(version)
+	if id, ok := r.aliases[version]; ok {
+		return id
+	}
+	return version
+}
+
+// 按配置文件中的顺序返回所有编译器
+func (r *compilerRegistry) all() []Compiler {
+	res := make([]Compiler, 0, len(r.order))
+	for _, id := range r.order {
+		res = append(res, r.compilers[id])
+	}
+	return res
+}
+
+// 返回与链上编译器名称和版本一致的编译器对应的Version取值，没有注册时返回toolchain()
+func (r *compilerRegistry) match(identity compilerIdentity) string {
+	for _, c := range r.all() {
+		if c.Identity().Name == identity.Name && c.Identity().Version == identity.Version {
+			return c.ID()
+		}
+	}
+	return identity.toolchain()
+}
+
+type baseCompiler struct {
+	config compilerConfig
+}
+
+func (c baseCompiler) ID() string {
+	return c.config.ID
+}
+
+func (c baseCompiler) Identity() compilerIdentity {
+	return compilerIdentity{Name: c.config.Name, Version: c.config.Version}
+}
+
+func (c baseCompiler) Language() string {
+	return c.config.Language
+}
+
+func (c baseCompiler) Options() []string {
+	return c.config.Options
+}
+
+func (c baseCompiler) Config() compilerConfig {
+	return c.config
+}
+
+func (c baseCompiler) Timeout() time.Duration {
+	return c.config.timeout
+}
+
+func (c baseCompiler) Install(ctx context.Context) error {
+	return installToolchain(ctx, c.config)
+}
+
+func (c baseCompiler) ParseOptions(m map[string]string) ([]compileOption, error) {
+	return parseOptions(c.ID(), c.config.schema, m)
+}
+
+// 生成配置中的命令，加上校验之后的编译选项，在上传文件的目录中执行
+func (c baseCompiler) BuildCommand(pathFile string, folderName string, m map[string]string) (*exec.Cmd, error) {
+	options, err := c.ParseOptions(m)
+	if err != nil {
+		return nil, err
+	}
+	args := []string{}
+	for _, o := range options {
+		args = append(args, o.args()...)
+	}
+	return c.command(pathFile, args...), nil
+}
+
+func (c baseCompiler) command(pathFile string, args ...string) *exec.Cmd {
+	cmd := exec.Command(c.config.Command[0], append(c.config.Command[1:], args...)...)
+	cmd.Dir = pathFile + "/"
+	return cmd
+}
+
+// C#编译器编译合约项目，输出在合约项目目录下的bin/sc目录中，文件名为项目的AssemblyName
+type csharpCompiler struct {
+	baseCompiler
+}
+
+// csproj中的AssemblyName
+var assemblyNameRegex = regexp.MustCompile(`<AssemblyName>\s*([^<\s]+)\s*</AssemblyName>`)
+
+func (c csharpCompiler) BuildCommand(pathFile string, folderName string, m map[string]string) (*exec.Cmd, error) {
+	project, err := c.contractProject(pathFile, m)
+	if err != nil {
+		return nil, err
+	}
+	cmd, err := c.baseCompiler.BuildCommand(pathFile, folderName, m)
+	if err != nil {
+		return nil, err
+	}
+	m["ContractProject"] = project
+	cmd.Args = append(cmd.Args, project)
+	return cmd, nil
+}
+
+func (c csharpCompiler) OutputPath(pathFile string, m map[string]string) (string, string) {
+	project, err := c.contractProject(pathFile, m)
+	if err != nil {
+		return pathFile + "/bin/sc/", ""
+	}
+	dir := pathFile + "/" + path.Dir(project) + "/bin/sc/"
+	name := strings.TrimSuffix(path.Base(project), ".csproj")
+	if data, err := ioutil.ReadFile(pathFile + "/" + project); err == nil {
+		if s := assemblyNameRegex.FindSubmatch(data); s != nil {
+			name = string(s[1])
+		}
+	}
+	//部分编译器版本按合约名称命名输出文件，这时使用该目录下唯一的.nef文件
+	if _, err := os.Stat(dir + name + ".nef"); err != nil {
+		if matches, _ := filepath.Glob(dir + "*.nef"); len(matches) == 1 {
+			name = strings.TrimSuffix(filepath.Base(matches[0]), ".nef")
+		}
+	}
+	return dir, name
+}
+
+func (c csharpCompiler) Diagnostics(pathFile string, m map[string]string, output compileOutput) []diagnostic {
+	return parseNccsDiagnostics(pathFile, output)
+}
+
+// 返回合约项目的csproj文件相对于上传目录的路径，用户没有通过ContractProject字段指定时使用唯一的csproj文件
+func (c csharpCompiler) contractProject(pathFile string, m map[string]string) (string, error) {
+	if project := strings.TrimSpace(getContractProject(m)); project != "" {
+		project = path.Clean(project)
+		if path.IsAbs(project) || project == ".." || strings.HasPrefix(project, "../") || path.Ext(project) != ".csproj" {
+			return "", errors.New("Contract project " + project + " must be a relative path to a .csproj file")
+		}
+		if _, err := os.Stat(pathFile + "/" + project); err != nil {
+			return "", errors.New("Contract project " + project + " isn't uploaded")
+		}
+		return project, nil
+	}
+	files, _ := walkSources(pathFile)
+	projects := []string{}
+	for _, f := range files {
+		if path.Ext(f) == ".csproj" {
+			projects = append(projects, f)
+		}
+	}
+	if len(projects) != 1 {
+		return "", errors.New("Please choose the contract project with ContractProject from: " + strings.Join(projects, ", "))
+	}
+	return projects[0], nil
+}
+
+// neo3-boa在上传目录中编译入口文件，输出与入口文件在同一目录，文件名与入口文件相同
+type pythonCompiler struct {
+	baseCompiler
+}
+
+func (c pythonCompiler) BuildCommand(pathFile string, folderName string, m map[string]string) (*exec.Cmd, error) {
+	entry, err := c.entryFile(pathFile, m)
+	if err != nil {
+		return nil, err
+	}
+	cmd, err := c.baseCompiler.BuildCommand(pathFile, folderName, m)
+	if err != nil {
+		return nil, err
+	}
+	m["EntryFile"] = entry
+	cmd.Args = append(cmd.Args, entry)
+	return cmd, nil
+}
+
+func (c pythonCompiler) OutputPath(pathFile string, m map[string]string) (string, string) {
+	entry, err := c.entryFile(pathFile, m)
+	if err != nil {
+		return pathFile + "/", ""
+	}
+	return pathFile + "/" + path.Dir(entry) + "/", strings.TrimSuffix(path.Base(entry), ".py")
+}
+
+func (c pythonCompiler) Diagnostics(pathFile string, m map[string]string, output compileOutput) []diagnostic {
+	entry, _ := c.entryFile(pathFile, m)
+	return parseBoaDiagnostics(pathFile, entry, output)
+}
+
+// 返回入口文件相对于上传目录的路径，用户没有通过EntryFile字段指定时使用上传目录下唯一的.py文件
+func (c pythonCompiler) entryFile(pathFile string, m map[string]string) (string, error) {
+	if entry := strings.TrimSpace(getEntryFile(m)); entry != "" {
+		entry = path.Clean(entry)
+		if path.IsAbs(entry) || entry == ".." || strings.HasPrefix(entry, "../") || path.Ext(entry) != ".py" {
+			return "", errors.New("Entry file " + entry + " must be a relative path to a .py file")
+		}
+		if _, err := os.Stat(pathFile + "/" + entry); err != nil {
+			return "", errors.New("Entry file " + entry + " isn't uploaded")
+		}
+		return entry, nil
+	}
+	matches, _ := filepath.Glob(pathFile + "/*.py")
+	if len(matches) != 1 {
+		return "", errors.New("Please choose the contract entry file with EntryFile")
+	}
+	return filepath.Base(matches[0]), nil
+}
+
+// neo-go按版本使用不同的可执行文件和interop模块，输出文件名中包含版本号
+type goCompiler struct {
+	baseCompiler
+}
+
+// 参数依次为interop模块、输出文件名和neo-go的编译参数，有合约配置文件时同时生成manifest
+func (c goCompiler) BuildCommand(pathFile string, folderName string, m map[string]string) (*exec.Cmd, error) {
+	options, err := c.ParseOptions(m)
+	if err != nil {
+		return nil, err
+	}
+	config, err := c.contractConfig(pathFile, m)
+	if err != nil {
+		return nil, err
+	}
+	_, out := c.OutputPath(pathFile, m)
+	args := []string{c.config.Interop, out}
+	if config != "" {
+		args = append(args, "-c", config, "-m", out+".manifest.json")
+	}
+	for _, o := range options {
+		switch o.Name {
+		case "--manifest":
+			if config == "" {
+				return nil, errors.New("Compile option --manifest requires a contract config file")
+			}
+		case "--debug":
+			args = append(args, "-d", out+".debug.json")
+		default:
+			args = append(args, o.args()...)
+		}
+	}
+	m["ContractConfig"] = config
+	return c.command(pathFile, args...), nil
+}
+
+// 返回合约配置文件名，用户没有通过ContractConfig字段指定时使用上传的唯一一个yml文件
+func (c goCompiler) contractConfig(pathFile string, m map[string]string) (string, error) {
+	if name := strings.TrimSpace(getContractConfig(m)); name != "" {
+		if name != filepath.Base(name) {
+			return "", errors.New("Contract config " + name + " must be a file name")
+		}
+		if _, err := os.Stat(pathFile + "/" + name); err != nil {
+			return "", errors.New("Contract config " + name + " isn't uploaded")
+		}
+		return name, nil
+	}
+	matches, _ := filepath.Glob(pathFile + "/*.yml")
+	if more, _ := filepath.Glob(pathFile + "/*.yaml"); len(more) != 0 {
+		matches = append(matches, more...)
+	}
+	if len(matches) > 1 {
+		return "", errors.New("Multiple contract config files are uploaded, please choose one with ContractConfig")
+	}
+	if len(matches) == 1 {
+		return filepath.Base(matches[0]), nil
+	}
+	return "", nil
+}
+
+func (c goCompiler) OutputPath(pathFile string, m map[string]string) (string, string) {
+	return pathFile + "/", "neo-go-" + c.config.Version
+}
+
+func (c goCompiler) Diagnostics(pathFile string, m map[string]string, output compileOutput) []diagnostic {
+	return parseNeoGoDiagnostics(pathFile, output)
+}
+
+// 合约类名，包含包名
+var javaClassRegex = regexp.MustCompile(`^[A-Za-z_$][A-Za-z0-9_$]*(\.[A-Za-z_$][A-Za-z0-9_$]*)*$`)
+
+// neow3j在上传文件目录下的neow3j子目录中生成单独的gradle工程，参数为neow3j版本和合约类名
+type javaCompiler struct {
+	baseCompiler
+}
+
+func (c javaCompiler) BuildCommand(pathFile string, folderName string, m map[string]string) (*exec.Cmd, error) {
+	if !javaClassRegex.MatchString(getJavaPackage(m)) {
+		return nil, errors.New("JavaPackage " + getJavaPackage(m) + " isn't a valid class name")
+	}
+	cmd, err := c.baseCompiler.BuildCommand(pathFile, folderName, m)
+	if err != nil {
+		return nil, err
+	}
+	cmd.Args = append(cmd.Args, c.config.Version, getJavaPackage(m))
+	return cmd, nil
+}
+
+func (c javaCompiler) OutputPath(pathFile string, m map[string]string) (string, string) {
+	dir := pathFile + "/neow3j/build/neow3j/"
+	file, _ := GetNameBySuffix(dir, ".nef")
+	return dir, file
+}
+
+func (c javaCompiler) Diagnostics(pathFile string, m map[string]string, output compileOutput) []diagnostic {
+	return parseGradleDiagnostics(pathFile, output)
+}
+
+// 定义验证记录中保存的编译设置，用于重现编译
+type buildSettings struct {
+	Compiler        string
+	CompileCommand  string
+	ContractConfig  string
+	EntryFile       string
+	ContractProject string
+	CompileFlags    []string
+	CompileOptions  []compileOption
+}
+
+func getBuildSettings(m map[string]string) buildSettings {
+	options := []compileOption{}
+	if c, err := compilers.lookup(getVersion(m)); err == nil {
+		options, _ = c.ParseOptions(m)
+	}
+	return buildSettings{compilers.resolve(getVersion(m)), strings.TrimSpace(getCompileCommand(m)), getContractConfig(m), getEntryFile(m), getContractProject(m), getCompileFlags(m), options}
+}
+
+// 编译器配置文件的路径，可以通过COMPILERS_CONFIG环境变量指定
+func compilersConfigFile() string {
+	if f := os.Getenv("COMPILERS_CONFIG"); f != "" {
+		return f
+	}
+	return "compilers.yml"
+}
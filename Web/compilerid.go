@@ -0,0 +1,87 @@
+package main
+
+import (
+	"regexp"
+	"strings"
+)
+
+// 定义编译器身份，由链上nef.compiler字段解析得到
+type compilerIdentity struct {
+	Name    string
+	Version string
+	Commit  string
+}
+
+var (
+	neoGoCompilerRegex  = regexp.MustCompile(`^neo-go-v?(\d+\.\d+\.\d+)`)
+	csharpCompilerRegex = regexp.MustCompile(`^Neo\.Compiler\.CSharp\s+v?(\d+\.\d+\.\d+)(?:\+(\S+))?`)
+	boaCompilerRegex    = regexp.MustCompile(`^neo3-boa.*?v?(\d+\.\d+\.\d+)`)
+	neow3jCompilerRegex = regexp.MustCompile(`^neow3j-v?(\d+\.\d+\.\d+)`)
+)
+
+// 解析链上nef.compiler字段，无法识别时返回false
+func parseCompiler(compiler string) (compilerIdentity, bool) {
+	compiler = strings.TrimSpace(strings.Trim(compiler, "\x00"))
+	if s := neoGoCompilerRegex.FindStringSubmatch(compiler); s != nil {
+		return compilerIdentity{Name: "neo-go", Version: s[1]}, true
+	}
+	if s := csharpCompilerRegex.FindStringSubmatch(compiler); s != nil {
+		return compilerIdentity{Name: "Neo.Compiler.CSharp", Version: s[1], Commit: s[2]}, true
+	}
+	if s := boaCompilerRegex.FindStringSubmatch(compiler); s != nil {
+		return compilerIdentity{Name: "neo3-boa", Version: s[1]}, true
+	}
+	if s := neow3jCompilerRegex.FindStringSubmatch(compiler); s != nil {
+		return compilerIdentity{Name: "neow3j", Version: s[1]}, true
+	}
+	return compilerIdentity{}, false
+}
+
+// 返回规范化的编译器名称，例如neo-go-0.98.0、Neo.Compiler.CSharp 3.1.0+<commit>、neo3-boa 0.11.3、neow3j-3.14.1
+func (c compilerIdentity) String() string {
+	switch c.Name {
+	case "neo-go", "neow3j":
+		return c.Name + "-" + c.Version
+	case "Neo.Compiler.CSharp":
+		if c.Commit != "" {
+			return c.Name + " " + c.Version + "+" + c.Commit
+		}
+		return c.Name + " " + c.Version
+	}
+	return c.Name + " " + c.Version
+}
+
+// 返回默认的上传表单Version字段取值，编译器注册表中没有相同版本时使用
+func (c compilerIdentity) toolchain() string {
+	switch c.Name {
+	case "neo-go", "neow3j":
+		return c.Name
+	}
+	return c.Name + " " + c.Version
+}
+
+// 根据链上的编译器选择编译器版本，如果用户选择的版本与链上不一致，返回警告信息
+func selectCompiler(m map[string]string, chainCompiler string) string {
+	identity, ok := parseCompiler(chainCompiler)
+	if !ok {
+		if getVersion(m) == "" {
+			return "Unknown on-chain compiler " + chainCompiler + ", please choose a compiler version"
+		}
+		return ""
+	}
+	if getVersion(m) == "" {
+		m["Version"] = compilers.match(identity)
+		if identity.Name == "Neo.Compiler.CSharp" && getCompileCommand(m) == "" {
+			m["CompileCommand"] = "nccs"
+		}
+		//链上版本没有注册时使用同名的默认编译器
+		if c, err := compilers.lookup(getVersion(m)); err == nil && c.Identity().Version != identity.Version {
+			return "On-chain compiler " + identity.String() + " isn't registered, using " + c.ID()
+		}
+		return ""
+	}
+	if compilers.resolve(getVersion(m)) != compilers.resolve(compilers.match(identity)) {
+		return "Selected compiler " + getVersion(m) + " doesn't match the on-chain compiler " + identity.String()
+	}
+	return ""
+}
@@ -0,0 +1,392 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/prometheus/client_golang/prometheus"
+	"gopkg.in/yaml.v3"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// 定义一种编译条件，每种条件只改变基准条件中的一项，便于判断是哪一项导致编译结果不同
+type determinismVariant struct {
+	Name       string
+	TZ         string
+	Locale     string
+	Reverse    bool
+	Timestamps bool
+	Dir        string
+}
+
+// 基准条件以及依次改变重复编译、文件顺序、文件修改时间、时区、语言环境和目录名的条件，
+// zh_CN.UTF-8需要在镜像中生成，见Dockerfile。
+// file order只改变创建文件的顺序，只有在按创建顺序返回目录项的文件系统（例如tmpfs）上编译器读到的顺序才会随之改变，
+// ext4和overlayfs按文件名的hash返回目录项，需要通过DETERMINISM_WORKDIR把检查目录放到tmpfs上，否则该条件与基准条件相同
+var determinismVariants = []determinismVariant{
+	{Name: "baseline", TZ: "UTC", Locale: "C.UTF-8", Dir: "contract"},
+	{Name: "repeat", TZ: "UTC", Locale: "C.UTF-8", Dir: "contract"},
+	{Name: "file order", TZ: "UTC", Locale: "C.UTF-8", Reverse: true, Dir: "contract"},
+	{Name: "timestamps", TZ: "UTC", Locale: "C.UTF-8", Timestamps: true, Dir: "contract"},
+	{Name: "timezone", TZ: "Asia/Shanghai", Locale: "C.UTF-8", Dir: "contract"},
+	{Name: "locale", TZ: "UTC", Locale: "zh_CN.UTF-8", Dir: "contract"},
+	{Name: "directory name", TZ: "UTC", Locale: "C.UTF-8", Dir: "renamed-contract"},
+}
+
+// 复制源文件时使用的修改时间，只有timestamps条件改变修改时间
+var determinismMtime = time.Date(2021, 1, 1, 0, 0, 0, 0, time.UTC)
+
+// 定义一个编译器和编译选项组合的确定性检查结果，Differences为与基准结果不同的条件和输出文件
+type determinismResult struct {
+	CompileCommand string    `yaml:"compileCommand,omitempty"`
+	Deterministic  bool      `yaml:"deterministic"`
+	Differences    []string  `yaml:"differences,omitempty"`
+	Error          string    `yaml:"error,omitempty"`
+	Checked        time.Time `yaml:"checked"`
+}
+
+var compilerDeterministic = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+	Name: "compiler_deterministic",
+	Help: "Whether the last determinism check of a compiler produced identical outputs under all conditions (1) or not (0).",
+}, []string{"compiler"})
+
+func init() {
+	prometheus.MustRegister(compilerDeterministic)
+}
+
+// 编译检查用源码的目录，可以通过DETERMINISM_WORKDIR环境变量指定，例如tmpfs上的/dev/shm
+func determinismWorkdir() string {
+	if d := os.Getenv("DETERMINISM_WORKDIR"); d != "" {
+		return d
+	}
+	return "."
+}
+
+// 保存确定性检查结果的文件，可以通过DETERMINISM_FILE环境变量指定
+func determinismFile() string {
+	if f := os.Getenv("DETERMINISM_FILE"); f != "" {
+		return f
+	}
+	return "determinism.yml"
+}
+
+// 读取每个编译器版本的确定性检查结果，文件不存在时返回空结果
+func loadDeterminism(file string) (map[string][]determinismResult, error) {
+	results := map[string][]determinismResult{}
+	data, err := ioutil.ReadFile(file)
+	if os.IsNotExist(err) {
+		return results, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	err = yaml.Unmarshal(data, &results)
+	return results, err
+}
+
+func saveDeterminism(file string, results map[string][]determinismResult) error {
+	data, err := yaml.Marshal(results)
+	if err != nil {
+		return err
+	}
+	data = append([]byte("# 由 ./main determinism 生成，记录每个编译器版本在不同条件下的编译结果是否一致\n"), data...)
+	return ioutil.WriteFile(file, data, 0666)
+}
+
+func (d determinismResult) status() string {
+	if d.Error != "" {
+		return "error: " + d.Error
+	}
+	if !d.Deterministic {
+		return "differs on " + strings.Join(d.Differences, ", ")
+	}
+	return "deterministic"
+}
+
+// 把检查结果中编译结果不一致的编译器标记为不稳定
+func (r *compilerRegistry) applyDeterminism(results map[string][]determinismResult) {
+	for _, c := range r.all() {
+		checked, ok := results[c.ID()]
+		if !ok {
+			continue
+		}
+		reason := ""
+		for _, d := range checked {
+			if !d.Deterministic && d.Error == "" {
+				reason = strings.TrimSpace(c.ID()+" "+d.CompileCommand) + " produces different outputs when changing " + strings.Join(d.Differences, ", ")
+				break
+			}
+		}
+		r.setFlaky(c.ID(), reason)
+		if reason == "" {
+			compilerDeterministic.WithLabelValues(c.ID()).Set(1)
+		} else {
+			compilerDeterministic.WithLabelValues(c.ID()).Set(0)
+		}
+	}
+}
+
+// 在每种条件下编译同一份源码，比较.nef和.manifest.json是否一致
+func checkDeterminism(c Compiler, src string, m map[string]string) determinismResult {
+	res := determinismResult{CompileCommand: getCompileCommand(m), Checked: time.Now().UTC()}
+	//按需安装的工具链需要先安装
+	err := c.Install(context.Background())
+	if err != nil {
+		res.Error = err.Error()
+		return res
+	}
+	root, err := ioutil.TempDir(determinismWorkdir(), "determinism-")
+	if err != nil {
+		res.Error = err.Error()
+		return res
+	}
+	defer os.RemoveAll(root)
+	all, err := walkSources(src)
+	if err != nil {
+		res.Error = err.Error()
+		return res
+	}
+	files := []string{}
+	for _, f := range all {
+		if !isBuildOutput(f) {
+			files = append(files, f)
+		}
+	}
+	var base [2]string
+	for i, v := range determinismVariants {
+		pathFile := filepath.Join(root, v.Dir)
+		os.RemoveAll(pathFile)
+		err = copyWorkspaceOrdered(src, pathFile, files, v.Reverse, v.Timestamps)
+		if err != nil {
+			res.Error = err.Error()
+			return res
+		}
+		nef, manifest, err := buildHashes(c, pathFile, copyParams(m), "TZ="+v.TZ, "LANG="+v.Locale, "LC_ALL="+v.Locale)
+		if err != nil {
+			res.Error = v.Name + ": " + err.Error()
+			return res
+		}
+		fmt.Println("Determinism: " + c.ID() + " " + v.Name + ": nef " + nef + ", manifest " + manifest)
+		if i == 0 {
+			base = [2]string{nef, manifest}
+			continue
+		}
+		if nef != base[0] {
+			res.Differences = append(res.Differences, v.Name+" (nef)")
+		}
+		if manifest != base[1] {
+			res.Differences = append(res.Differences, v.Name+" (manifest)")
+		}
+	}
+	res.Deterministic = len(res.Differences) == 0
+	return res
+}
+
+// 按指定的顺序复制源文件，所有文件使用相同的修改时间，timestamps为true时每个文件的修改时间都不同
+func copyWorkspaceOrdered(src string, dst string, files []string, reverse bool, timestamps bool) error {
+	err := os.MkdirAll(dst, 0777)
+	if err != nil {
+		return err
+	}
+	for i := range files {
+		f := files[i]
+		if reverse {
+			f = files[len(files)-1-i]
+		}
+		mtime := determinismMtime
+		if timestamps {
+			mtime = time.Now().Add(-time.Duration(i+1) * time.Hour)
+		}
+		data, err := ioutil.ReadFile(filepath.Join(src, f))
+		if err != nil {
+			return err
+		}
+		out, err := createUploadFile(dst, f)
+		if err != nil {
+			return err
+		}
+		_, err = out.Write(data)
+		out.Close()
+		if err != nil {
+			return err
+		}
+		err = os.Chtimes(filepath.Join(dst, f), mtime, mtime)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// 在pathFile中编译并返回.nef和.manifest.json文件的sha256，env为额外的环境变量
+func buildHashes(c Compiler, pathFile string, m map[string]string, env ...string) (string, string, error) {
+	cmd, err := c.BuildCommand(pathFile, filepath.Base(pathFile), m)
+	if err != nil {
+		return "", "", err
+	}
+	err = mirrors.apply(cmd, c.Language())
+	if err != nil {
+		return "", "", err
+	}
+	if len(env) > 0 {
+		if cmd.Env == nil {
+			cmd.Env = os.Environ()
+		}
+		cmd.Env = append(cmd.Env, env...)
+	}
+	output, err := runCompiler(context.Background(), c, cmd)
+	out := output.Stdout + output.Stderr
+	switch err.(type) {
+	case nil:
+	case *sandboxError, *timeoutError:
+		return "", "", err
+	default:
+		return "", "", fmt.Errorf("%v: %s", err, lastLines(out, 5))
+	}
+	dir, file := c.OutputPath(pathFile, m)
+	nef, err := fileSha256(dir + file + ".nef")
+	if err != nil {
+		return "", "", errors.New(".nef file doesn't exist: " + lastLines(out, 5))
+	}
+	manifest, _ := fileSha256(dir + file + ".manifest.json")
+	return nef, manifest, nil
+}
+
+// 向用户返回的警告信息中增加一条
+func addWarning(m map[string]string, warning string) {
+	if getWarning(m) == "" {
+		m["Warning"] = warning
+	} else {
+		m["Warning"] = getWarning(m) + "; " + warning
+	}
+}
+
+// 检查编译器确定性的命令：
+//
+//	determinism run [<compiler id>...]                        用测试合约检查编译器的每种编译选项
+//	determinism check <compiler id> <dir> [<field>=<value>...]  用指定目录中的源码和表单字段检查
+//	determinism list                                          列出保存的检查结果
+func determinismCommand(args []string) int {
+	registry, err := loadCompilerRegistry(compilersConfigFile())
+	if err != nil {
+		fmt.Println(err)
+		return 1
+	}
+	mirrors, err = loadMirrors(mirrorDir())
+	if err != nil {
+		fmt.Println(err)
+		return 1
+	}
+	results, err := loadDeterminism(determinismFile())
+	if err != nil {
+		fmt.Println(err)
+		return 1
+	}
+	if len(args) == 1 && args[0] == "list" {
+		for _, c := range registry.all() {
+			for _, d := range results[c.ID()] {
+				fmt.Println(strings.TrimSpace(c.ID()+" "+d.CompileCommand) + "\t" + d.status())
+			}
+		}
+		return 0
+	}
+	checked := map[string][]determinismResult{}
+	if len(args) >= 1 && args[0] == "run" {
+		cfg, err := loadSelfTestConfig(fixturesDir())
+		if err != nil {
+			fmt.Println(err)
+			return 1
+		}
+		targets := registry.all()
+		if len(args) > 1 {
+			targets = nil
+			for _, id := range args[1:] {
+				c, err := registry.lookup(id)
+				if err != nil {
+					fmt.Println(err)
+					return 1
+				}
+				targets = append(targets, c)
+			}
+		}
+		for _, c := range targets {
+			fixture := cfg.fixture(c.Language())
+			if fixture == nil {
+				fmt.Println(c.ID() + "\tno fixture for " + c.Language())
+				continue
+			}
+			src, err := ioutil.TempDir(".", "fixture-")
+			if err != nil {
+				fmt.Println(err)
+				return 1
+			}
+			err = copyFixture(filepath.Join(fixturesDir(), fixture.Dir), src, c.Identity().Version)
+			if err != nil {
+				os.RemoveAll(src)
+				fmt.Println(err)
+				return 1
+			}
+			options := c.Options()
+			if len(options) == 0 {
+				options = []string{""}
+			}
+			for _, o := range options {
+				m := map[string]string{"CompileCommand": o}
+				for k, v := range fixture.Form {
+					m[k] = v
+				}
+				checked[c.ID()] = append(checked[c.ID()], checkDeterminism(c, src, m))
+			}
+			os.RemoveAll(src)
+		}
+	} else if len(args) >= 3 && args[0] == "check" {
+		c, err := registry.lookup(args[1])
+		if err != nil {
+			fmt.Println(err)
+			return 1
+		}
+		m := map[string]string{}
+		for _, kv := range args[3:] {
+			i := strings.Index(kv, "=")
+			if i <= 0 {
+				fmt.Println("invalid form field " + kv + ", please use <field>=<value>")
+				return 2
+			}
+			m[kv[:i]] = kv[i+1:]
+		}
+		checked[c.ID()] = append(checked[c.ID()], checkDeterminism(c, args[2], m))
+	} else {
+		fmt.Println("usage: determinism run [<compiler id>...] | determinism check <compiler id> <dir> [<field>=<value>...] | determinism list")
+		return 2
+	}
+	flaky := 0
+	for id, list := range checked {
+		//同一个编译选项只保留最新的结果
+		for _, d := range list {
+			kept := []determinismResult{}
+			for _, old := range results[id] {
+				if old.CompileCommand != d.CompileCommand {
+					kept = append(kept, old)
+				}
+			}
+			results[id] = append(kept, d)
+			if d.Error == "" && !d.Deterministic {
+				flaky++
+			}
+			fmt.Println(strings.TrimSpace(id+" "+d.CompileCommand) + "\t" + d.status())
+		}
+	}
+	err = saveDeterminism(determinismFile(), results)
+	if err != nil {
+		fmt.Println(err)
+		return 1
+	}
+	if flaky > 0 {
+		return 1
+	}
+	return 0
+}
@@ -0,0 +1,14 @@
+using Neo.SmartContract.Framework;
+using System.ComponentModel;
+
+namespace Fixture
+{
+    [DisplayName("Fixture")]
+    public class Fixture : SmartContract
+    {
+        public static int Main()
+        {
+            return 42;
+        }
+    }
+}
@@ -0,0 +1,5 @@
+package fixture
+
+func Main() int {
+	return 42
+}
@@ -0,0 +1,12 @@
+package io.neow3j.selftest;
+
+import io.neow3j.devpack.annotations.DisplayName;
+
+@DisplayName("Fixture")
+public class Fixture {
+
+    public static int main() {
+        return 42;
+    }
+
+}
@@ -0,0 +1,6 @@
+from boa3.builtin import public
+
+
+@public
+def main() -> int:
+    return 42
@@ -1,4 +1,42 @@
 #!/bin/bash
-
+#参数依次为neo-go可执行文件、interop模块（module@version）、输出文件名（不含后缀）和编译参数，由compilers.yml配置
 export GOROOT="/usr/local/go"
-neo-go contract compile -i ./
\ No newline at end of file
+NEOGO=$1
+INTEROP=$2
+OUT=$3
+shift 3
+
+#没有上传go.mod时，使用与neo-go版本对应的interop模块，编译之后删除生成的go.mod
+#使用本地镜像时（设置了MIRROR_GOSUM），生成的go.mod使用镜像中对照sum.golang.org校验过的go.sum，
+#上传的go.mod按上传的go.sum（没有上传时使用镜像中的go.sum）校验，不允许修改；go.sum中没有记录的模块需要访问sum.golang.org，沙箱中会编译失败
+GENERATED=""
+GENERATED_SUM=""
+if [ ! -f go.mod ]
+then
+  go mod init contract
+  if [ -n "$MIRROR_GOSUM" ]
+  then
+    cp "$MIRROR_GOSUM" go.sum
+  fi
+  go mod edit -require=$INTEROP
+  go mod tidy
+  GENERATED="true"
+elif [ -n "$MIRROR_GOSUM" ]
+then
+  if [ ! -f go.sum ]
+  then
+    cp "$MIRROR_GOSUM" go.sum
+    GENERATED_SUM="true"
+  fi
+  export GOFLAGS=-mod=readonly
+fi
+
+$NEOGO contract compile -i ./ -o $OUT.nef "$@"
+
+if [ -n "$GENERATED" ]
+then
+  rm -f go.mod go.sum
+elif [ -n "$GENERATED_SUM" ]
+then
+  rm -f go.sum
+fi
@@ -0,0 +1,226 @@
+package main
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/nspcc-dev/neo-go/pkg/core/interop/interopnames"
+	"github.com/nspcc-dev/neo-go/pkg/smartcontract/nef"
+	"github.com/nspcc-dev/neo-go/pkg/util"
+	"github.com/tidwall/gjson"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// ContractManagement原生合约的hash
+const contractManagementHash = "0xfffdc93764dbaddd97c48f252a53ea4643faa3fd"
+
+// 获取用户指定的合约更新次数，没有指定时返回false
+func getTargetUpdateCounter(m map[string]string) (int, bool) {
+	if strings.TrimSpace(m["UpdateCounter"]) == "" {
+		return 0, false
+	}
+	counter, err := strconv.Atoi(strings.TrimSpace(m["UpdateCounter"]))
+	if err != nil {
+		return -1, true
+	}
+	return counter, true
+}
+
+// watcher记录的ContractManagement通知，用于查找合约每个版本的部署或更新交易
+const contractEventCollection = "VerifyContractEvents"
+
+// 定义一条ContractManagement的Deploy、Update或Destroy通知，Blockindex、Txindex和Index依次为区块高度、
+// 交易在区块中的位置以及通知在交易中的位置，按这三项排序即为链上的顺序
+type contractEvent struct {
+	Hash       string
+	Event      string
+	Txhash     string
+	Blockindex int
+	Txindex    int
+	Index      int
+}
+
+// 在通知记录的合约hash和链上顺序上建立索引
+func ensureContractEventIndex(ctx context.Context, db *mongo.Database) error {
+	keys := bson.D{{Key: "hash", Value: 1}, {Key: "blockindex", Value: 1}, {Key: "txindex", Value: 1}, {Key: "index", Value: 1}}
+	_, err := db.Collection(contractEventCollection).Indexes().CreateOne(ctx, mongo.IndexModel{Keys: keys})
+	return err
+}
+
+// 保存一条通知，重复处理同一个区块时不会重复插入
+func saveContractEvent(ctx context.Context, db *mongo.Database, e contractEvent) error {
+	filter := bson.M{"txhash": e.Txhash, "index": e.Index}
+	_, err := db.Collection(contractEventCollection).ReplaceOne(ctx, filter, e, options.Replace().SetUpsert(true))
+	return err
+}
+
+// 根据watcher记录的通知找到合约指定版本的交易：counter为0时是Deploy交易，否则是按链上顺序的第counter个Update交易。
+// watcher按顺序处理区块，记录中有合约的Deploy通知时，之后的Update通知才是完整的
+func findVersionTransaction(ctx context.Context, db *mongo.Database, contract string, counter int) (string, error) {
+	collection := db.Collection(contractEventCollection)
+	var deploy contractEvent
+	err := collection.FindOne(ctx, bson.M{"hash": contract, "event": "Deploy"}).Decode(&deploy)
+	if err != nil {
+		return "", errors.New("the deploy transaction of this contract hasn't been indexed, the blocks before the watcher started have to be indexed with ./main watcher backfill")
+	}
+	if counter == 0 {
+		return deploy.Txhash, nil
+	}
+	sort := bson.D{{Key: "blockindex", Value: 1}, {Key: "txindex", Value: 1}, {Key: "index", Value: 1}}
+	cursor, err := collection.Find(ctx, bson.M{"hash": contract, "event": "Update"}, options.Find().SetSort(sort).SetSkip(int64(counter-1)).SetLimit(1))
+	if err != nil {
+		return "", err
+	}
+	var updates []contractEvent
+	err = cursor.All(ctx, &updates)
+	if err != nil {
+		return "", err
+	}
+	if len(updates) == 0 {
+		return "", fmt.Errorf("update %d of this contract hasn't been indexed yet", counter)
+	}
+	return updates[0].Txhash, nil
+}
+
+// 从部署或者更新合约的交易中获取指定版本的nef和manifest，交易根据watcher记录的通知查找
+func getHistoricalState(pathFile string, w http.ResponseWriter, m1 map[string]string, m2 map[string]int, counter int) (contractState, string) {
+	var state contractState
+	cfg, err := OpenConfigFile()
+	if err == nil {
+		ctx := context.TODO()
+		var co *mongo.Client
+		var dbonline string
+		co, dbonline, err = connectMongo(cfg, ctx)
+		if err == nil {
+			state, err = historicalState(ctx, co.Database(dbonline), getContract(m1), counter, getUpdateCounter(m2))
+			co.Disconnect(ctx)
+		}
+	}
+	if err != nil {
+		fmt.Println("=================Historical contract version error: " + err.Error() + "===============")
+		msg, _ := json.Marshal(jsonResult{Code: 9, Msg: "Historical contract version error: " + err.Error()})
+		w.Header().Set("Content-Type", "application/json")
+		w.Write(msg)
+		os.RemoveAll(pathFile)
+		return contractState{}, "9"
+	}
+	m2["updateCounter"] = counter
+	return state, ""
+}
+
+func historicalState(ctx context.Context, db *mongo.Database, contract string, counter int, current int) (contractState, error) {
+	if counter < 0 || counter > current {
+		return contractState{}, fmt.Errorf("invalid update counter, the current update counter is %d", current)
+	}
+	txHash, err := findVersionTransaction(ctx, db, contract, counter)
+	if err != nil {
+		return contractState{}, err
+	}
+	return stateFromTransaction(contract, txHash, counter)
+}
+
+// 从交易中取出部署或更新合约时的nef和manifest，counter为0时交易必须是Deploy交易，否则必须是Update交易
+func stateFromTransaction(contract string, txHash string, counter int) (contractState, error) {
+	//确认交易执行成功，并且ContractManagement发出了该合约的Deploy或Update通知
+	body, err := rpcCall("getapplicationlog", []interface{}{txHash})
+	if err != nil {
+		return contractState{}, err
+	}
+	if gjson.GetBytes(body, "error").Exists() {
+		return contractState{}, errors.New(gjson.GetBytes(body, "error.message").String())
+	}
+	event := ""
+	for _, execution := range gjson.GetBytes(body, "result.executions").Array() {
+		if execution.Get("vmstate").String() != "HALT" {
+			continue
+		}
+		for _, n := range execution.Get("notifications").Array() {
+			if n.Get("contract").String() != contractManagementHash {
+				continue
+			}
+			hash, err := base64.StdEncoding.DecodeString(n.Get("state.value.0.value").String())
+			if err != nil {
+				continue
+			}
+			u, err := util.Uint160DecodeBytesBE(hash)
+			if err != nil || "0x"+u.StringLE() != strings.ToLower(contract) {
+				continue
+			}
+			event = n.Get("eventname").String()
+		}
+	}
+	if event == "" {
+		return contractState{}, errors.New("the transaction doesn't deploy or update this contract")
+	}
+	if (event == "Deploy") != (counter == 0) {
+		return contractState{}, errors.New("the transaction is a " + event + " transaction, which doesn't match update counter " + strconv.Itoa(counter))
+	}
+	//从交易的脚本中取出deploy或update调用的nef和manifest参数
+	body, err = rpcCall("getrawtransaction", []interface{}{txHash, true})
+	if err != nil {
+		return contractState{}, err
+	}
+	if gjson.GetBytes(body, "error").Exists() {
+		return contractState{}, errors.New(gjson.GetBytes(body, "error.message").String())
+	}
+	script, err := base64.StdEncoding.DecodeString(gjson.GetBytes(body, "result.script").String())
+	if err != nil {
+		return contractState{}, err
+	}
+	nefBytes, manifestBytes, err := extractDeployArgs(script)
+	if err != nil {
+		return contractState{}, err
+	}
+	nefFile, err := nef.FileFromBytes(nefBytes)
+	if err != nil {
+		return contractState{}, err
+	}
+	nefJSON, err := json.Marshal(nefFile)
+	if err != nil {
+		return contractState{}, err
+	}
+	return contractState{nefFile.Compiler, base64.StdEncoding.EncodeToString(nefFile.Script), string(nefJSON), string(manifestBytes)}, nil
+}
+
+// 在交易脚本中找到最后一个deploy或update调用，返回它的nef和manifest参数
+func extractDeployArgs(script []byte) ([]byte, []byte, error) {
+	ins, err := disassemble(script)
+	if err != nil {
+		return nil, nil, err
+	}
+	callID := make([]byte, 4)
+	binary.LittleEndian.PutUint32(callID, interopnames.ToID([]byte(interopnames.SystemContractCall)))
+	//System.Contract.Call之前依次是参数（倒序）、参数个数、PACK、call flags、方法名和合约hash
+	for i := len(ins) - 1; i >= 7; i-- {
+		if ins[i].Opcode != "SYSCALL" || ins[i].Operand != hex.EncodeToString(callID) {
+			continue
+		}
+		method, err := hex.DecodeString(ins[i-2].Operand)
+		if err != nil || (string(method) != "deploy" && string(method) != "update") {
+			continue
+		}
+		if ins[i-4].Opcode != "PACK" {
+			continue
+		}
+		nefBytes, err := hex.DecodeString(ins[i-6].Operand)
+		if err != nil || !strings.HasPrefix(ins[i-6].Opcode, "PUSHDATA") {
+			continue
+		}
+		manifestBytes, err := hex.DecodeString(ins[i-7].Operand)
+		if err != nil || !strings.HasPrefix(ins[i-7].Opcode, "PUSHDATA") {
+			continue
+		}
+		return nefBytes, manifestBytes, nil
+	}
+	return nil, nil, errors.New("no deploy or update call found in the transaction script")
+}
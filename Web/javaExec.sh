@@ -1,44 +1,32 @@
 #!/bin/bash
-cd javacontractgradle/build/neow3j
-rm -f *
-cd ../..
-
-cd javacontractgradle
-rm -f build.gradle
-cd ..
-cp $2/build.gradle javacontractgradle/
-
-#sed -i "28c className ="$1"" build.gradle
-
-OPTS=""
-SLASH="/"
-JAVA=".java"
-var=$1
-var=${var//./ }
-for element in $var
-do
-    OPTS="$OPTS$element$SLASH"
-done
-OPTS=${OPTS%?}
-echo $OPTS
-ClassName=${OPTS##*/}
-echo $ClassName
-
-Package=${OPTS%/*}
+#参数依次为neow3j版本和合约类名（包含包名），在上传文件的目录中执行，由compilers.yml配置
+#每个任务在自己的目录中根据javacontractgradle模板生成gradle工程，所有任务共享GRADLE_USER_HOME中的依赖缓存
+VERSION=$1
+CLASS=$2
+TEMPLATE=/go/application/javacontractgradle
+PROJECT=./neow3j
+export GRADLE_USER_HOME=${GRADLE_USER_HOME:-/go/application/gradle-cache}
+
+Package=${CLASS%.*}
+if [ "$Package" == "$CLASS" ]
+then
+  Package=""
+fi
+Package=${Package//./\/}
 echo $Package
 
-cd javacontractgradle/src/main/java
-
-rm -rf *
-
-mkdir -p $Package
-
-cd $Package
-
-cd /go/application
-
-cp $2/*.java javacontractgradle/src/main/java/$Package/
-
-cd /go/application/javacontractgradle
-
-./gradlew neow3jCompile
+rm -rf $PROJECT
+mkdir -p $PROJECT/src/main/java/$Package
+cp -r $TEMPLATE/gradlew $TEMPLATE/gradle $TEMPLATE/settings.gradle $PROJECT/
+sed -e "s/@NEOW3J_VERSION@/$VERSION/g" -e "s/@CLASS_NAME@/$CLASS/g" $TEMPLATE/build.gradle.template > $PROJECT/build.gradle
+cp *.java $PROJECT/src/main/java/$Package/
+
+#默认只使用缓存中的依赖，GRADLE_OFFLINE=false时允许下载
+OFFLINE="--offline"
+if [ "$GRADLE_OFFLINE" == "false" ]
+then
+  OFFLINE=""
+fi
+
+cd $PROJECT
+./gradlew $OFFLINE neow3jCompile
@@ -0,0 +1,213 @@
+package main
+
+import (
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"github.com/nspcc-dev/neo-go/pkg/smartcontract/manifest"
+	"github.com/nspcc-dev/neo-go/pkg/smartcontract/nef"
+	"strings"
+)
+
+// 验证等级
+const (
+	// script、tokens和manifest全部一致
+	levelExact = "Exact"
+	// script和tokens一致，manifest或nef只有extra、source等不影响执行的差异，或者编译器没有生成manifest
+	levelScript = "Script"
+	// 只有script中嵌入的元数据（manifest的extra、nef的source和compiler）不同，其它部分全部一致
+	levelPartial = "Partial"
+)
+
+// 不影响合约执行的manifest字段
+var cosmeticManifestFields = map[string]bool{"extra": true}
+
+// 不影响合约执行的nef字段，source变化会导致checksum变化
+var cosmeticNefFields = map[string]bool{"source": true, "compiler": true, "checksum": true}
+
+// 根据script、nef和manifest的比对结果计算验证等级，不匹配时返回空字符串。
+// manifest或nef读取失败、有实质差异时都视为不匹配，Partial由partialMatch单独判断。
+// 编译器没有生成manifest时（neo-go没有上传合约配置文件）无法比较manifest，最高只能是Script
+func verificationLevel(localScript string, chainScript string, manifestResult manifestReport, nefResult nefReport) string {
+	if localScript != chainScript || nefResult.Error != "" {
+		return ""
+	}
+	level := levelExact
+	if manifestResult.Error == manifestMissing {
+		level = levelScript
+	} else if manifestResult.Error != "" {
+		return ""
+	}
+	for _, field := range manifestResult.Mismatched {
+		if !cosmeticManifestFields[field] {
+			return ""
+		}
+		level = levelScript
+	}
+	for _, field := range nefResult.Mismatched {
+		if !cosmeticNefFields[field] {
+			return ""
+		}
+		level = levelScript
+	}
+	return level
+}
+
+// 定义一项嵌入script的元数据在本地编译结果和链上的取值
+type metadataPair struct {
+	Name  string
+	Local string
+	Chain string
+}
+
+// 判断script的差异是否只来自嵌入的元数据。只有同一位置的PUSHDATA在本地等于某项元数据的本地取值、
+// 在链上等于同一项元数据的链上取值时才忽略差异，跳转目标和ABI中的方法偏移换算成指令序号，
+// 其它指令、tokens以及manifest中extra之外的字段都必须一致
+func partialMatch(pathFile string, m map[string]string, state contractState) bool {
+	localNef, err := readLocalNef(pathFile, m)
+	if err != nil {
+		return false
+	}
+	localManifest, err := readLocalManifest(pathFile, m)
+	if err != nil {
+		return false
+	}
+	var chainNef nef.File
+	if json.Unmarshal([]byte(state.Nef), &chainNef) != nil {
+		return false
+	}
+	var chainManifest manifest.Manifest
+	if json.Unmarshal([]byte(state.Manifest), &chainManifest) != nil {
+		return false
+	}
+	pairs := metadataPairs(localNef, chainNef, localManifest, &chainManifest)
+	if len(pairs) == 0 {
+		return false
+	}
+	localIndex, chainIndex, ok := scriptsMatchNormalized(localNef.Script, chainNef.Script, pairs)
+	if !ok {
+		return false
+	}
+	for _, field := range compareNef(&localNef, &chainNef) {
+		if field != "script" && !cosmeticNefFields[field] {
+			return false
+		}
+	}
+	for _, field := range compareManifest(localManifest, &chainManifest).Mismatched {
+		if field == "abi" && jsonEqual(abiWithIndexes(localManifest.ABI, localIndex), abiWithIndexes(chainManifest.ABI, chainIndex)) {
+			continue
+		}
+		if !cosmeticManifestFields[field] {
+			return false
+		}
+	}
+	fmt.Println("Partial match after normalizing metadata:", pairs)
+	return true
+}
+
+// 返回本地和链上取值不同的元数据：manifest extra中的字符串以及nef的source和compiler
+func metadataPairs(localNef nef.File, chainNef nef.File, localManifest *manifest.Manifest, chainManifest *manifest.Manifest) []metadataPair {
+	pairs := []metadataPair{}
+	if localNef.Source != chainNef.Source && localNef.Source != "" && chainNef.Source != "" {
+		pairs = append(pairs, metadataPair{"source", localNef.Source, chainNef.Source})
+	}
+	if localNef.Compiler != chainNef.Compiler && localNef.Compiler != "" && chainNef.Compiler != "" {
+		pairs = append(pairs, metadataPair{"compiler", localNef.Compiler, chainNef.Compiler})
+	}
+	var localExtra, chainExtra map[string]interface{}
+	json.Unmarshal(localManifest.Extra, &localExtra)
+	json.Unmarshal(chainManifest.Extra, &chainExtra)
+	for key, l := range localExtra {
+		ls, ok := l.(string)
+		if !ok {
+			continue
+		}
+		cs, ok := chainExtra[key].(string)
+		if ok && ls != cs && ls != "" && cs != "" {
+			pairs = append(pairs, metadataPair{"extra." + key, ls, cs})
+		}
+	}
+	return pairs
+}
+
+// 逐条比较两个script的指令，返回两边offset到指令序号的映射
+func scriptsMatchNormalized(local []byte, chain []byte, pairs []metadataPair) (map[int]int, map[int]int, bool) {
+	localIns, err := disassemble(local)
+	if err != nil {
+		return nil, nil, false
+	}
+	chainIns, err := disassemble(chain)
+	if err != nil {
+		return nil, nil, false
+	}
+	if len(localIns) != len(chainIns) {
+		return nil, nil, false
+	}
+	localIndex := instructionIndexes(localIns)
+	chainIndex := instructionIndexes(chainIns)
+	for i := range localIns {
+		l, c := localIns[i], chainIns[i]
+		if l.Opcode != c.Opcode {
+			return nil, nil, false
+		}
+		if lt := jumpTargets(l); lt != nil {
+			ct := jumpTargets(c)
+			for j := range lt {
+				li, ok1 := localIndex[lt[j]]
+				ci, ok2 := chainIndex[ct[j]]
+				if !ok1 || !ok2 || li != ci {
+					return nil, nil, false
+				}
+			}
+			continue
+		}
+		if l.Operand == c.Operand {
+			continue
+		}
+		if !strings.HasPrefix(l.Opcode, "PUSHDATA") || !isMetadataOperand(l.Operand, c.Operand, pairs) {
+			return nil, nil, false
+		}
+	}
+	return localIndex, chainIndex, true
+}
+
+func instructionIndexes(ins []instruction) map[int]int {
+	index := make(map[int]int, len(ins))
+	for i, in := range ins {
+		index[in.Offset] = i
+	}
+	return index
+}
+
+// 判断两个PUSHDATA的操作数是否为同一项元数据在本地和链上的取值
+func isMetadataOperand(local string, chain string, pairs []metadataPair) bool {
+	l, err := hex.DecodeString(local)
+	if err != nil {
+		return false
+	}
+	c, err := hex.DecodeString(chain)
+	if err != nil {
+		return false
+	}
+	for _, p := range pairs {
+		if string(l) == p.Local && string(c) == p.Chain {
+			return true
+		}
+	}
+	return false
+}
+
+// 把ABI中方法的offset换算成指令序号，offset不在指令边界上时记为-1
+func abiWithIndexes(abi manifest.ABI, index map[int]int) manifest.ABI {
+	methods := make([]manifest.Method, len(abi.Methods))
+	for i, method := range abi.Methods {
+		n, ok := index[method.Offset]
+		if !ok {
+			n = -1
+		}
+		method.Offset = n
+		methods[i] = method
+	}
+	abi.Methods = methods
+	return abi
+}
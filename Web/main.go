@@ -65,8 +65,26 @@ type Config struct {
 
 //定义http应答返回格式
 type jsonResult struct {
-	Code int
-	Msg  string
+	Code     int
+	Msg      string
+	Level    string          `json:",omitempty"`
+	Manifest *manifestReport `json:",omitempty"`
+	Nef      *nefReport      `json:",omitempty"`
+	Search   *searchReport   `json:",omitempty"`
+	Diff     *opcodeDiff     `json:",omitempty"`
+	Methods  *methodReport   `json:",omitempty"`
+	Warning  string          `json:",omitempty"`
+	//编译器输出的错误和警告，编译失败并且没有解析出错误时Output为编译输出的最后几行
+	Diagnostics []diagnostic `json:",omitempty"`
+	Output      string       `json:",omitempty"`
+}
+
+//定义链上合约状态，Nef和Manifest为getcontractstate返回的原始json
+type contractState struct {
+	Compiler string
+	Script   string
+	Nef      string
+	Manifest string
 }
 
 //定义插入VerifiedContract表的数据格式, 记录被验证的合约
@@ -74,6 +92,17 @@ type insertVerifiedContract struct {
 	Hash          string
 	Id            int
 	Updatecounter int
+	Manifest      manifestReport
+	Level         string
+	Status        string
+	NefHash       string
+	ManifestHash  string
+	ScriptHash    string
+	Build         buildSettings
+	CarriedFrom   *int `bson:",omitempty"`
+	//通过相同字节码匹配时，指向原合约的hash和更新次数
+	SimilarTo      string `bson:",omitempty"`
+	SimilarCounter *int   `bson:",omitempty"`
 }
 
 //定义插入ContractSourceCode表的数据格式，记录被验证的合约源代码
@@ -120,46 +149,103 @@ func multipleFile(w http.ResponseWriter, r *http.Request) {
 				m1[part.FormName()] = string(data)
 			} else if part.FormName() == "JavaPackage" {
 				m1[part.FormName()] = string(data)
+			} else if part.FormName() == "Strict" {
+				m1[part.FormName()] = string(data)
+			} else if part.FormName() == "Search" {
+				m1[part.FormName()] = string(data)
+			} else if part.FormName() == "UpdateCounter" {
+				m1[part.FormName()] = string(data)
+			} else if part.FormName() == "CompileFlags" {
+				m1[part.FormName()] = string(data)
+			} else if part.FormName() == "ContractConfig" {
+				m1[part.FormName()] = string(data)
+			} else if part.FormName() == "EntryFile" {
+				m1[part.FormName()] = string(data)
+			} else if part.FormName() == "ContractProject" {
+				m1[part.FormName()] = string(data)
+			} else if part.FormName() == "CompileOptions" {
+				m1[part.FormName()] = string(data)
 			}
 		} else {
-			//dst,_ :=os.Create("./"+part.FileName()
-			dst, _ := os.OpenFile(pathFile+"/"+part.FileName(), os.O_WRONLY|os.O_CREATE, 0666)
-			defer dst.Close()
-			io.Copy(dst, part)
-			fileExt := path.Ext(pathFile + "/" + part.FileName())
-			if fileExt == ".csproj" {
-				point := strings.Index(part.FileName(), ".")
-				tmp := part.FileName()[0:point]
-				m1["Filename"] = tmp
-			} else if fileExt == ".py" {
-				point := strings.Index(part.FileName(), ".")
-				tmp := part.FileName()[0:point]
-				m1["Filename"] = tmp
-			} else if fileExt == ".java" {
-				point := strings.Index(part.FileName(), ".")
-				tmp := part.FileName()[0:point]
-				m1["Filename"] = tmp
+			//保留上传文件的目录结构
+			name, err := uploadFileName(part)
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				os.RemoveAll(pathFile)
+				return
+			}
+			dst, err := createUploadFile(pathFile, name)
+			if err != nil {
+				fmt.Println("Create upload file error:", err)
+				http.Error(w, "failed to save uploaded file "+name, http.StatusInternalServerError)
+				os.RemoveAll(pathFile)
+				return
+			}
+			_, err = io.Copy(dst, part)
+			dst.Close()
+			if err != nil {
+				http.Error(w, "failed to save uploaded file "+name, http.StatusBadRequest)
+				os.RemoveAll(pathFile)
+				return
 			}
-
 		}
 
 	}
 
+	//向链上结点请求合约的状态，返回请求到的合约nef数据
+	state, code := getContractState(pathFile, w, m1, m2)
+	//如果请求失败，程序不向下执行
+	if code == "3" || code == "4" {
+		return
+	}
+	//指定了历史版本的更新次数时，从部署或更新合约的交易中获取该版本的nef和manifest，验证记录保存在该更新次数下
+	if counter, ok := getTargetUpdateCounter(m1); ok && counter != getUpdateCounter(m2) {
+		state, code = getHistoricalState(pathFile, w, m1, m2, counter)
+		if code == "9" {
+			return
+		}
+	}
+	//根据链上nef.compiler字段选择编译器，Version字段为空时自动选择，与用户选择不一致时给出警告
+	m1["Warning"] = selectCompiler(m1, state.Compiler)
 	//编译用户上传的合约源文件，并返回编译后的.nef数据
-	chainNef := execCommand(pathFile, folderName, w, m1)
+	chainNef := execCommand(r.Context(), pathFile, folderName, w, m1)
 	//如果编译出错，程序不向下执行
-	if chainNef == "0" || chainNef == "1" || chainNef == "2" {
+	if isCompileError(chainNef) {
 		return
 
 	}
-	//向链上结点请求合约的状态，返回请求到的合约nef数据
-	version, sourceNef := getContractState(pathFile, w, m1, m2)
-	//如果请求失败，程序不向下执行
-	if sourceNef == "3" || sourceNef == "4" {
-		return
+	//比较编译生成的manifest与链上的manifest，记录每个字段的比对结果
+	manifestResult := verifyManifest(pathFile, m1, state.Manifest)
+	//比较编译生成的nef与链上的nef的全部字段，严格模式下任一字段不一致都视为验证失败
+	nefResult := verifyNefFields(pathFile, m1, state.Nef)
+	//根据比对结果计算验证等级，等级为空表示验证失败
+	level := verificationLevel(chainNef, state.Script, manifestResult, nefResult)
+	if getStrict(m1) && (len(nefResult.Mismatched) != 0 || nefResult.Error != "") {
+		level = ""
+	}
+	//如果比对失败并且开启了搜索模式，用同一语言的其它编译器版本和选项重新编译
+	var searchResult *searchReport
+	if level == "" && getSearch(m1) {
+		report, matchDir := searchCompilers(r.Context(), pathFile, folderName, m1, state)
+		searchResult = &report
+		if matchDir != "" {
+			//使用匹配的编译结果替换原来的编译目录，之后的比对和入库都基于匹配的编译器版本
+			os.RemoveAll(pathFile)
+			os.Rename(matchDir, pathFile)
+			m1["Version"] = report.Match
+			m1["CompileCommand"] = report.CompileCommand
+			chainNef = state.Script
+			manifestResult = verifyManifest(pathFile, m1, state.Manifest)
+			nefResult = verifyNefFields(pathFile, m1, state.Nef)
+			level = verificationLevel(chainNef, state.Script, manifestResult, nefResult)
+		}
+	}
+	//script只有嵌入的元数据不同时记为Partial，使用单独的状态和返回码，严格模式下不接受
+	if level == "" && !getStrict(m1) && !isCompileError(chainNef) && partialMatch(pathFile, m1, state) {
+		level = levelPartial
 	}
 	//比较用户上传的源代码编译的.nef文件与链上存储的合约.nef数据是否相等，如果相等的话，向数据库插入数据
-	if sourceNef == chainNef {
+	if level != "" {
 		//打开数据库配置文件
 		cfg, err := OpenConfigFile()
 		if err != nil {
@@ -177,7 +263,11 @@ func multipleFile(w http.ResponseWriter, r *http.Request) {
 		//如果合约不存在于VerifiedContract表中，验证成功
 		if result.Err() != nil {
 			//在VerifyContract表中插入该合约信息
-			verified := insertVerifiedContract{getContract(m1), getId(m2), getUpdateCounter(m2)}
+			status := statusVerified
+			if level == levelPartial {
+				status = statusPartial
+			}
+			verified := insertVerifiedContract{Hash: getContract(m1), Id: getId(m2), Updatecounter: getUpdateCounter(m2), Manifest: manifestResult, Level: level, Status: status, NefHash: nefHash(state.Nef), ManifestHash: manifestHash(state.Manifest), ScriptHash: scriptHash(state.Nef), Build: getBuildSettings(m1)}
 			var insertOne *mongo.InsertOneResult
 			insertOne, err = co.Database(dbonline).Collection("VerifyContractModel").InsertOne(ctx, verified)
 			fmt.Println("Connect to mainnet database")
@@ -187,72 +277,76 @@ func multipleFile(w http.ResponseWriter, r *http.Request) {
 			}
 			fmt.Println("Inserted a verified Contract in verifyContractModel collection in"+rt+" database", insertOne.InsertedID)
 			//在ContractSourceCode表中，插入上传的合约源代码。
-			rd, err := ioutil.ReadDir(pathFile + "/")
+			rd, err := walkSources(pathFile)
 			if err != nil {
 				fmt.Println(err)
 			}
-			for _, fi := range rd {
-				if fi.IsDir() {
-					continue
-				} else {
-					if getVersion(m1) == "neo3-boa" {
-						fileExt := path.Ext(fi.Name())
-						if fileExt != ".py" {
-							continue
-						}
-					} else if getVersion(m1) == "neow3j" {
-						fileExt := path.Ext(fi.Name())
-						if fileExt != ".java" {
-							continue
-						}
-					} else if getVersion(m1) == "neo-go" {
-						fileExt := path.Ext(fi.Name())
-						if fileExt != ".go" {
-							continue
-						}
-					}
-					fmt.Println(fi.Name())
-					file, err := os.Open(pathFile + "/" + fi.Name())
-					if err != nil {
-						log.Fatal(err)
+			language := ""
+			if compiler, err := compilers.lookup(getVersion(m1)); err == nil {
+				language = compiler.Language()
+			}
+			for _, name := range rd {
+				if language == "python" {
+					fileExt := path.Ext(name)
+					if fileExt != ".py" {
+						continue
 					}
-					defer file.Close()
-					fileinfo, err := file.Stat()
-					if err != nil {
-						log.Fatal(err)
+				} else if language == "java" {
+					fileExt := path.Ext(name)
+					if fileExt != ".java" {
+						continue
 					}
-					filesize := fileinfo.Size()
-					buffer := make([]byte, filesize)
-					_, err = file.Read(buffer)
-					if err != nil {
-						log.Fatal(err)
-
+				} else if language == "go" {
+					fileExt := path.Ext(name)
+					if fileExt != ".go" && fileExt != ".yml" && path.Base(name) != "go.mod" && path.Base(name) != "go.sum" {
+						continue
 					}
+				}
+				fmt.Println(name)
+				file, err := os.Open(pathFile + "/" + name)
+				if err != nil {
+					log.Fatal(err)
+				}
+				defer file.Close()
+				fileinfo, err := file.Stat()
+				if err != nil {
+					log.Fatal(err)
+				}
+				filesize := fileinfo.Size()
+				buffer := make([]byte, filesize)
+				_, err = file.Read(buffer)
+				if err != nil {
+					log.Fatal(err)
 
-					var insertOneSourceCode *mongo.InsertOneResult
-					sourceCode := insertContractSourceCode{getContract(m1), getUpdateCounter(m2), fi.Name(), string(buffer)}
-					if rt == "mainnet" {
-						insertOneSourceCode, err = co.Database(dbonline).Collection("ContractSourceCode").InsertOne(ctx, sourceCode)
-					} else {
-						insertOneSourceCode, err = co.Database(dbonline).Collection("ContractSourceCode").InsertOne(ctx, sourceCode)
-					}
+				}
 
-					if err != nil {
-						log.Fatal(err)
-					}
-					fmt.Println("Inserted a contract source code in contractSourceCode collection in "+rt+"database", insertOneSourceCode.InsertedID)
+				var insertOneSourceCode *mongo.InsertOneResult
+				sourceCode := insertContractSourceCode{getContract(m1), getUpdateCounter(m2), name, string(buffer)}
+				if rt == "mainnet" {
+					insertOneSourceCode, err = co.Database(dbonline).Collection("ContractSourceCode").InsertOne(ctx, sourceCode)
+				} else {
+					insertOneSourceCode, err = co.Database(dbonline).Collection("ContractSourceCode").InsertOne(ctx, sourceCode)
+				}
 
+				if err != nil {
+					log.Fatal(err)
 				}
+				fmt.Println("Inserted a contract source code in contractSourceCode collection in "+rt+"database", insertOneSourceCode.InsertedID)
+
 			}
 			fmt.Println("=================Insert verified contract in database===============")
-			msg, _ := json.Marshal(jsonResult{5, "Verify done and record verified contract in database!"})
+			code, text := 5, "Verify done and record verified contract in database!"
+			if level == levelPartial {
+				code, text = 11, "Partial match: the script only matches after normalizing embedded metadata, recorded as partial"
+			}
+			msg, _ := json.Marshal(jsonResult{Code: code, Msg: text, Level: level, Manifest: &manifestResult, Nef: &nefResult, Search: searchResult, Warning: getWarning(m1), Diagnostics: loadDiagnostics(pathFile)})
 			w.Header().Set("Content-Type", "application/json")
 			os.Rename(pathFile, getContract(m1))
 			w.Write(msg)
 			//如果合约存在于VerifiedContract表中，说明合约已经被验证过，不会存新的数据
 		} else {
 			fmt.Println("=================This contract has already been verified===============")
-			msg, _ := json.Marshal(jsonResult{6, "This contract has already been verified"})
+			msg, _ := json.Marshal(jsonResult{Code: 6, Msg: "This contract has already been verified", Warning: getWarning(m1)})
 			w.Header().Set("Access-Control-Allow-Origin", "*")
 			w.Header().Set("Content-Type", "application/json")
 			os.RemoveAll(pathFile)
@@ -262,9 +356,19 @@ func multipleFile(w http.ResponseWriter, r *http.Request) {
 
 		////比较用户上传的源代码编译的.nef文件与链上存储的合约.nef数据是否相等，如果不等的话，返回以下内容
 	} else {
-		fmt.Println(version)
+		fmt.Println(state.Compiler)
 		fmt.Println("=================Your source code doesn't match the contract on bloackchain===============")
-		msg, _ := json.Marshal(jsonResult{8, "Contract Source Code Verification error!"})
+		//反汇编本地和链上的script，返回指令级的差异
+		var diffResult *opcodeDiff
+		var methodResult *methodReport
+		if chainNef != state.Script {
+			diff := diffScripts(chainNef, state.Script)
+			diffResult = &diff
+			//按ABI中的方法切分script，找出不一致的方法
+			methods := verifyMethods(pathFile, m1, chainNef, state)
+			methodResult = &methods
+		}
+		msg, _ := json.Marshal(jsonResult{Code: 8, Msg: "Contract Source Code Verification error!", Manifest: &manifestResult, Nef: &nefResult, Search: searchResult, Diff: diffResult, Methods: methodResult, Warning: getWarning(m1), Diagnostics: loadDiagnostics(pathFile)})
 		w.Header().Set("Content-Type", "application/json")
 		w.Write(msg)
 
@@ -285,225 +389,89 @@ func createDateDir(basepath string) (string, string) {
 
 }
 
-//编译用户上传的合约源码
-func execCommand(pathFile string, folderName string, w http.ResponseWriter, m map[string]string) string {
-	//cmd := exec.Command("ls")
-	//根据用户上传参数选择对应的编译器
-	cmd := exec.Command("echo")
-	if getVersion(m) == "neo3-boa 0.11.4" {
-		cmd = exec.Command("/bin/sh","/go/application/pythonExec.sh","boa114")
-		fmt.Println("Compiler: neo3-boa, Command: neo3-boa 0.11.4")
-	}else if getVersion(m) == "neo3-boa 0.11.3" {
-		cmd = exec.Command("/bin/sh","/go/application/pythonExec.sh","boa113")
-		fmt.Println("Compiler: neo3-boa, Command: neo3-boa 0.11.3")
-	}else if getVersion(m) == "neo3-boa 0.11.2" {
-		cmd = exec.Command("/bin/sh","/go/application/pythonExec.sh","boa112")
-		fmt.Println("Compiler: neo3-boa, Command: neo3-boa 0.11.2")
-	}else if getVersion(m) == "neo3-boa 0.11.1" {
-		cmd = exec.Command("/bin/sh","/go/application/pythonExec.sh","boa111")
-		fmt.Println("Compiler: neo3-boa, Command: neo3-boa 0.11.1")
-	}else if getVersion(m) == "neo3-boa 0.11.0" {
-		cmd = exec.Command("/bin/sh","/go/application/pythonExec.sh","boa110")
-		fmt.Println("Compiler: neo3-boa, Command: neo3-boa 0.11.0")
-	}else if getVersion(m) == "neo3-boa 0.10.1" {
-		cmd = exec.Command("/bin/sh","/go/application/pythonExec.sh","boa101")
-		fmt.Println("Compiler: neo3-boa, Command: neo3-boa 0.10.1")
-	}else if getVersion(m) == "neo3-boa 0.10.0" {
-		cmd = exec.Command("/bin/sh","/go/application/pythonExec.sh","boa100")
-		fmt.Println("Compiler: neo3-boa, Command: neo3-boa 0.10.0")
-	}else if getVersion(m) == "neo3-boa 0.9.0" {
-		cmd = exec.Command("/bin/sh","/go/application/pythonExec.sh","boa090")
-		fmt.Println("Compiler: neo3-boa, Command: neo3-boa 0.9.0")
-	}else if getVersion(m) == "neo3-boa 0.8.3" {
-		cmd = exec.Command("/bin/sh",  "/go/application/pythonExec.sh","boa083")
-		fmt.Println("Compiler: neo3-boa, Command: neo3-boa 0.8.3")
-	}else if getVersion(m) == "neo3-boa 0.8.2" {
-		cmd = exec.Command("/bin/sh","/go/application/pythonExec.sh","boa082")
-		fmt.Println("Compiler: neo3-boa, Command: neo3-boa 0.8.2")
-	}else if getVersion(m) == "neo3-boa 0.8.1" {
-		cmd = exec.Command("/bin/sh","/go/application/pythonExec.sh","boa081")
-		fmt.Println("Compiler: neo3-boa, Command: neo3-boa 0.8.1")
-	}else if getVersion(m) == "neo3-boa 0.8.0" {
-		cmd = exec.Command("/bin/sh","/go/application/pythonExec.sh","boa080")
-		fmt.Println("Compiler: neo3-boa, Command: neo3-boa 0.8.0")
-	}else if getVersion(m) == "neo3-boa 0.7.0" {
-		cmd = exec.Command("/bin/sh","/go/application/pythonExec.sh","boa070")
-		fmt.Println("Compiler: neo3-boa, Command: neo3-boa 0.7.0")
-	}else if getVersion(m) == "neo3-boa 0.3.0" {
-		cmd = exec.Command("/bin/sh","/go/application/pythonExec.sh","boa030")
-		fmt.Println("Compiler: neo3-boa, Command: neo3-boa 0.3.0")
-	}else if getVersion(m) == "neo3-boa 0.0.3" {
-		cmd = exec.Command("/bin/sh","/go/application/pythonExec.sh","boa003")
-		fmt.Println("Compiler: neo3-boa, Command: neo3-boa 0.0.3")
-	}else if getVersion(m) == "neo3-boa 0.0.0" {
-		cmd = exec.Command("/bin/sh","/go/application/pythonExec.sh","boa000")
-		fmt.Println("Compiler: neo3-boa, Command: neo3-boa 0.0.0")
-	}else if getVersion(m) == "neow3j" {
-		command := "/go/application/javaExec.sh " + getJavaPackage(m) + " " + folderName
-		cmd = exec.Command("/bin/sh", "-c", command)
-		fmt.Println(command, "Compiler: neow3j, Command:"+"/go/application/javaExec.sh "+getJavaPackage(m)+" "+folderName)
-	} else if getVersion(m) == "neo-go" {
-		cmd = exec.Command("/bin/sh", "-c", "/go/application/goExec.sh")
-		fmt.Println("Compiler: neo-go, Command: neo-go")
-	} else if getVersion(m) == "Neo.Compiler.CSharp 3.0.0" {
-		if getCompileCommand(m) == "nccs --no-optimize" {
-			cmd = exec.Command("/go/application/c/nccs", "--no-optimize")
-			fmt.Println("Compiler: Neo.Compiler.CSharp 3.0.0, Command: nccs --no-optimize")
-		}
-		if getCompileCommand(m) == "nccs" {
-			cmd = exec.Command("/go/application/c/nccs")
-			fmt.Println("Compiler: Neo.Compiler.CSharp 3.0.0, Command: nccs")
-		}
+//编译用户上传的合约源码，编译出错时向用户返回错误信息
+func execCommand(ctx context.Context, pathFile string, folderName string, w http.ResponseWriter, m map[string]string) string {
+	result := compileContract(ctx, pathFile, folderName, m)
+	var msg []byte
+	if result == "0" {
+		msg, _ = json.Marshal(jsonResult{Code: 0, Msg: m["CompilerError"], Warning: getWarning(m)})
+		os.RemoveAll(pathFile)
+	} else if result == "1" {
+		msg, _ = json.Marshal(jsonResult{Code: 1, Msg: "Cmd execution failed ", Warning: getWarning(m)})
+		os.RemoveAll(pathFile)
+	} else if result == "2" {
+		diagnostics, output := compileDiagnostics(pathFile)
+		msg, _ = json.Marshal(jsonResult{Code: 2, Msg: ".nef file doesn't exist ", Warning: getWarning(m), Diagnostics: diagnostics, Output: output})
+	} else if result == sandboxViolationCode {
+		diagnostics, output := compileDiagnostics(pathFile)
+		msg, _ = json.Marshal(jsonResult{Code: 7, Msg: m["SandboxError"], Warning: getWarning(m), Diagnostics: diagnostics, Output: output})
+		removeExceptCompileLog(pathFile)
+	} else if result == compileTimeoutCode {
+		diagnostics, output := compileDiagnostics(pathFile)
+		msg, _ = json.Marshal(jsonResult{Code: 10, Msg: m["TimeoutError"], Warning: getWarning(m), Diagnostics: diagnostics, Output: output})
+		removeExceptCompileLog(pathFile)
+	} else {
+		return result
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(msg)
+	return result
+}
 
-	} else if getVersion(m) == "Neo.Compiler.CSharp 3.0.2" {
-		if getCompileCommand(m) == "nccs --no-optimize" {
-			cmd = exec.Command("/go/application/b/nccs", "--no-optimize")
-			fmt.Println("Compiler: Neo.Compiler.CSharp 3.0.2, Command: nccs --no-optimize")
-		}
-		if getCompileCommand(m) == "nccs" {
-			cmd = exec.Command("/go/application/b/nccs")
-			fmt.Println("Compiler: Neo.Compiler.CSharp 3.0.2, Command: nccs")
-		}
+//判断compileContract的返回值是否为错误码
+func isCompileError(result string) bool {
+	return result == "0" || result == "1" || result == "2" || result == sandboxViolationCode || result == compileTimeoutCode
+}
 
-	} else if getVersion(m) == "Neo.Compiler.CSharp 3.0.3" {
-		if getCompileCommand(m) == "nccs --no-optimize" {
-			cmd = exec.Command("/go/application/a/nccs", "--no-optimize")
-			fmt.Println("Compiler: Neo.Compiler.CSharp 3.0.3, Command: nccs --no-optimize")
-		}
-		if getCompileCommand(m) == "nccs" {
-			cmd = exec.Command("/go/application/a/nccs")
-			fmt.Println("Compiler: Neo.Compiler.CSharp 3.0.3, Command: nccs")
-		}
-	} else if getVersion(m) == "Neo.Compiler.CSharp 3.1.0" {
-		if getCompileCommand(m) == "nccs --no-optimize" {
-			cmd = exec.Command("dotnet", "/go/application/compiler2/3.1/net6.0/nccs.dll", "--no-optimize")
-			fmt.Println("Compiler: Neo.Compiler.CSharp 3.1.0, Command: nccs --no-optimize")
-		}
-		if getCompileCommand(m) == "nccs" {
-			cmd = exec.Command("dotnet", "/go/application/compiler2/3.1/net6.0/nccs.dll")
-			fmt.Println("Compiler: Neo.Compiler.CSharp 3.1.0, Command: nccs")
-		}
-	} else if getVersion(m) == "Neo.Compiler.CSharp 3.3.0" {
-		if getCompileCommand(m) == "nccs --no-optimize" {
-			cmd = exec.Command("dotnet", "/go/application/compiler2/3.3/net6.0/nccs.dll", "--no-optimize")
-			fmt.Println("Compiler: Neo.Compiler.CSharp 3.3.0, Command: nccs --no-optimize")
-		}
-		if getCompileCommand(m) == "nccs" {
-			cmd = exec.Command("dotnet", "/go/application/compiler2/3.3/net6.0/nccs.dll")
-			fmt.Println("Compiler: Neo.Compiler.CSharp 3.3.0, Command: nccs")
-		}
-	} else if getVersion(m) == "Neo.Compiler.CSharp 3.4.0" {
-		if getCompileCommand(m) == "nccs --no-optimize" {
-			cmd = exec.Command("dotnet", "/go/application/compiler2/3.4/net6.0/nccs.dll", "--no-optimize")
-			fmt.Println("Compiler: Neo.Compiler.CSharp 3.4.0, Command: nccs --no-optimize")
-		}
-		if getCompileCommand(m) == "nccs" {
-			cmd = exec.Command("dotnet", "/go/application/compiler2/3.4/net6.0/nccs.dll")
-			fmt.Println("Compiler: Neo.Compiler.CSharp 3.4.0, Command: nccs")
-		}
-	}else {
+//编译合约源码并返回编译后.nef中的script，编译出错时返回错误码"0"、"1"、"2"，违反沙箱限制时返回"7"，
+//超时或者ctx被取消（例如用户断开连接）时返回"10"
+func compileContract(ctx context.Context, pathFile string, folderName string, m map[string]string) string {
+	//根据用户上传参数从编译器注册表中选择对应的编译器
+	compiler, err := compilers.lookup(getVersion(m))
+	if err != nil {
 		fmt.Println("===============Compiler version doesn't exist==============")
-		msg, _ := json.Marshal(jsonResult{0, "Compiler version doesn't exist, please choose Neo.Compiler.CSharp 3.0.0/Neo.Compiler.CSharp 3.0.2/Neo.Compiler.CSharp 3.0.3 version"})
-		w.Header().Set("Content-Type", "application/json")
-		w.Write(msg)
-		os.RemoveAll(pathFile)
+		m["CompilerError"] = err.Error()
 		return "0"
 	}
-
-	if getVersion(m) != "neow3j" {
-		cmd.Dir = pathFile + "/"
-	}else{
-		cmd.Dir = "./"
+	//编译器在不同条件下编译结果不一致时提醒用户
+	if reason := compilers.flakyReason(compiler.ID()); reason != "" {
+		addWarning(m, "Compiler isn't deterministic: "+reason)
 	}
-
-	stdout, err := cmd.StdoutPipe()
+	cmd, err := compiler.BuildCommand(pathFile, folderName, m)
 	if err != nil {
-		log.Fatal(err)
+		fmt.Println("===============Compile command doesn't exist==============")
+		m["CompilerError"] = err.Error()
+		return "0"
 	}
-	defer stdout.Close()
-
-	err = cmd.Start()
+	fmt.Println("Compiler: "+compiler.ID()+", Command: "+strings.Join(cmd.Args, " "))
+	//配置了本地镜像时，编译只使用镜像中的依赖
+	err = mirrors.apply(cmd, compiler.Language())
 	if err != nil {
-		fmt.Println("=============== Cmd execution failed==============")
-		msg, _ := json.Marshal(jsonResult{1, "Cmd execution failed "})
-		w.Header().Set("Content-Type", "application/json")
-		w.Write(msg)
-		os.RemoveAll(pathFile)
+		fmt.Println("=============== Mirror configuration failed==============", err)
 		return "1"
-
 	}
-
-	opBytes, err := ioutil.ReadAll(stdout)
-	if err != nil {
-		log.Fatal(err)
-	} else {
-		fmt.Println(string(opBytes))
-	}
-	//
-	version:=getVersion(m)
-	version =strings.Trim(version," ")
-	str:=strings.Split(version," ")
-	fmt.Println(str[0],version)
-	if str[0] == "neo3-boa" {
-		file,_:= GetNameBySuffix(pathFile + "/" ,".nef")
-		_, err = os.Lstat(pathFile + "/" + file + ".nef")
-		fmt.Println("check python nef")
-	} else if getVersion(m) == "neo-go" {
-		_, err = os.Lstat(pathFile + "/" + "out.nef")
-		fmt.Println("check go nef")
-	} else if getVersion(m) == "neow3j" {
-		files, _ := ioutil.ReadDir("./javacontractgradle/build/neow3j/")
-		for _, f := range files {
-			if path.Ext("./"+f.Name()) == ".nef" {
-				m["Filename"] = f.Name()
-				break
-			}    
+	//源码、编译器和编译选项都相同时直接使用缓存中的编译结果，不再重新编译
+	hash := buildCacheHash(compiler, pathFile, m)
+	if !restoreBuild(compiler, hash, pathFile) {
+		code := runBuild(ctx, compiler, cmd, pathFile, m)
+		if code != "" {
+			return code
 		}
-		_, err = os.Lstat("./javacontractgradle/build/neow3j/" + m["Filename"])
-		fmt.Println("find java nef file")
-	} else {
-		//获取当前nef 文件的名称         合约displayname
-		file,_:= GetNameBySuffix(pathFile + "/" + "bin/sc/",".nef")
-		//_, err = os.Lstat(pathFile + "/" + "bin/sc/" + m["Filename"] + ".nef")
-
-		_, err = os.Lstat(pathFile + "/" + "bin/sc/" + file + ".nef")
-
-		fmt.Println("there")
+		storeBuild(compiler, hash, pathFile, m)
 	}
+	dir, file := getOutputPath(pathFile, m)
+	_, err = os.Lstat(dir + file + ".nef")
 	fmt.Println(err)
 	if !os.IsNotExist(err) {
 		var res nef.File
 
-		if str[0] == "neo3-boa" {
-			file,_:= GetNameBySuffix(pathFile + "/" ,".nef")
-			f, err := ioutil.ReadFile(pathFile + "/" + file + ".nef")
-			if err != nil {
-				log.Fatal(err)
-			}
-			res, err = nef.FileFromBytes(f)
-			if err != nil {
-				log.Fatal("error")
-			}
-		} else if getVersion(m) == "neow3j"{
-			f, err:= ioutil.ReadFile("./javacontractgradle/build/neow3j/"+m["Filename"])
-			if err != nil {
-				log.Fatal("error")
-			}
-			res, err = nef.FileFromBytes(f)
-			if err != nil {
-				log.Fatal("error")
-			}
-		} else {
-			file,_:= GetNameBySuffix(pathFile + "/" + "bin/sc/",".nef")
-
-			f, err := ioutil.ReadFile(pathFile + "/" + "bin/sc/" + file + ".nef")
-			if err != nil {
-				log.Fatal(err)
-			}
-			res, err = nef.FileFromBytes(f)
-			if err != nil {
-				log.Fatal("error")
-			}
+		f, err := ioutil.ReadFile(dir + file + ".nef")
+		if err != nil {
+			log.Fatal(err)
+		}
+		res, err = nef.FileFromBytes(f)
+		if err != nil {
+			log.Fatal("error")
 		}
 
 		//fmt.Println(res.Script)
@@ -516,15 +484,54 @@ func execCommand(pathFile string, folderName string, w http.ResponseWriter, m ma
 	} else {
 
 		fmt.Println("============.nef file doesn't exist===========", err)
-		msg, _ := json.Marshal(jsonResult{2, ".nef file doesn't exist "})
-		w.Header().Set("Content-Type", "application/json")
-		w.Write(msg)
-
 		return "2"
 
 	}
 
 }
+
+//安装工具链并执行编译命令，编译命令正常结束或者编译失败（之后检查.nef文件）时返回空，其它情况返回错误码
+func runBuild(ctx context.Context, compiler Compiler, cmd *exec.Cmd, pathFile string, m map[string]string) string {
+	//第一次使用时安装编译器的工具链
+	err := compiler.Install(ctx)
+	if err != nil {
+		fmt.Println("===============Toolchain installation failed==============", err)
+		m["CompilerError"] = "Toolchain of " + compiler.ID() + " couldn't be installed: " + err.Error()
+		return "0"
+	}
+	//在沙箱中执行编译命令，只能写入上传目录，不能访问网络，超过编译器的超时时间时结束编译
+	output, err := runCompiler(ctx, compiler, cmd)
+	fmt.Println(output.Stdout)
+	//解析编译输出中的错误和警告，与编译输出一起保存在上传目录中
+	if logErr := saveCompileLog(pathFile, output, compiler.Diagnostics(pathFile, m, output)); logErr != nil {
+		fmt.Println("=============== Compile log couldn't be saved==============", logErr)
+	}
+	switch err := err.(type) {
+	case nil, *exec.ExitError:
+	case *timeoutError:
+		fmt.Println("=============== Compilation timed out==============", err)
+		m["TimeoutError"] = err.Error()
+		return compileTimeoutCode
+	case *sandboxError:
+		fmt.Println("=============== Sandbox violation==============", err)
+		m["SandboxError"] = err.Error()
+		return sandboxViolationCode
+	default:
+		fmt.Println("=============== Cmd execution failed==============", err)
+		return "1"
+	}
+	return ""
+}
+
+//获取编译生成的.nef文件所在的目录以及文件名（不含后缀），.manifest.json文件与.nef文件在同一目录
+func getOutputPath(pathFile string, m map[string]string) (string, string) {
+	compiler, err := compilers.lookup(getVersion(m))
+	if err != nil {
+		return pathFile + "/", ""
+	}
+	return compiler.OutputPath(pathFile, m)
+}
+
 func verifyNef(name string) string {
 	f, err := ioutil.ReadFile("./" + name + ".nef")
 	if err != nil {
@@ -544,57 +551,32 @@ func verifyNef(name string) string {
 }
 
 // 向链上结点请求合约的nef数据
-func getContractState(pathFile string, w http.ResponseWriter, m1 map[string]string, m2 map[string]int) (string, string) {
-	rt := os.ExpandEnv("${RUNTIME}")
-	var resp *http.Response
-	payload, err := json.Marshal(map[string]interface{}{
-		"jsonrpc": "2.0",
-		"method":  "getcontractstate",
-		"params": []interface{}{
-			getContract(m1),
-		},
-		"id": 1,
-	})
-	if rt != "mainnet" && rt != "testnet" && rt != "testmagnet" {
-		rt = "mainnet"
-	}
+func getContractState(pathFile string, w http.ResponseWriter, m1 map[string]string, m2 map[string]int) (contractState, string) {
 	fmt.Println("RPC params: ContractHash:" + getContract(m1))
-	switch rt {
-	case "mainnet":
-		resp, err = http.Post(RPCNODEMAIN, "application/json", bytes.NewReader(payload))
-		fmt.Println("Runtime is:" + rt)
-	case "testnet":
-		resp, err = http.Post(RPCNODETEST, "application/json", bytes.NewReader(payload))
-		fmt.Println("Runtime is:" + rt)
-	case "testmagnet":
-		resp, err = http.Post(RPCNODETESTMAGNET, "application/json", bytes.NewReader(payload))
-		fmt.Println("Runtime is:" + rt)
-	}
-
+	body, err := rpcCall("getcontractstate", []interface{}{getContract(m1)})
 	if err != nil {
 		fmt.Println("=================RPC Node doesn't exsite===============")
-		msg, _ := json.Marshal(jsonResult{3, "RPC Node doesn't exsite! "})
+		msg, _ := json.Marshal(jsonResult{Code: 3, Msg: "RPC Node doesn't exsite! "})
 		w.Header().Set("Content-Type", "application/json")
 		w.Write(msg)
 		os.RemoveAll(pathFile)
-		return "", "3"
+		return contractState{}, "3"
 	}
-	defer resp.Body.Close()
-
-	body, _ := ioutil.ReadAll(resp.Body)
 
 	if gjson.Get(string(body), "error").Exists() {
 		message := gjson.Get(string(body), "error.message").String()
 		fmt.Println("=================" + message + "===============")
-		msg, _ := json.Marshal(jsonResult{4, message})
+		msg, _ := json.Marshal(jsonResult{Code: 4, Msg: message})
 		w.Header().Set("Content-Type", "application/json")
 		w.Write(msg)
 		os.RemoveAll(pathFile)
-		return "", "4"
+		return contractState{}, "4"
 	}
 
 	nef := gjson.Get(string(body), "result.nef.script")
 	version := gjson.Get(string(body), "result.nef.compiler").String()
+	manifest := gjson.Get(string(body), "result.manifest").Raw
+	nefRaw := gjson.Get(string(body), "result.nef").Raw
 	updateCounter := gjson.Get(string(body), "result.updatecounter").String()
 	id := gjson.Get(string(body), "result.id").String()
 	m2["id"], _ = strconv.Atoi(id)
@@ -602,8 +584,42 @@ func getContractState(pathFile string, w http.ResponseWriter, m1 map[string]stri
 	//fmt.Println(base64.StdEncoding.DecodeString(sourceNef))
 	fmt.Println("===============Now is ChainNode nef===============")
 	fmt.Println(nef.String())
-	return version, nef.String()
+	return contractState{version, nef.String(), nefRaw, manifest}, ""
+
+}
 
+// 根据运行环境向对应的链上结点发送RPC请求，返回应答的body
+func rpcCall(method string, params []interface{}) ([]byte, error) {
+	rt := os.ExpandEnv("${RUNTIME}")
+	var resp *http.Response
+	payload, err := json.Marshal(map[string]interface{}{
+		"jsonrpc": "2.0",
+		"method":  method,
+		"params":  params,
+		"id":      1,
+	})
+	if err != nil {
+		return nil, err
+	}
+	if rt != "mainnet" && rt != "testnet" && rt != "testmagnet" {
+		rt = "mainnet"
+	}
+	switch rt {
+	case "mainnet":
+		resp, err = http.Post(RPCNODEMAIN, "application/json", bytes.NewReader(payload))
+		fmt.Println("Runtime is:" + rt)
+	case "testnet":
+		resp, err = http.Post(RPCNODETEST, "application/json", bytes.NewReader(payload))
+		fmt.Println("Runtime is:" + rt)
+	case "testmagnet":
+		resp, err = http.Post(RPCNODETESTMAGNET, "application/json", bytes.NewReader(payload))
+		fmt.Println("Runtime is:" + rt)
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	return ioutil.ReadAll(resp.Body)
 }
 
 func OpenConfigFile() (Config, error) {
@@ -624,6 +640,15 @@ func OpenConfigFile() (Config, error) {
 
 //链接主网和测试网数据库
 func intializeMongoOnlineClient(cfg Config, ctx context.Context) (*mongo.Client, string) {
+	co, dbOnline, err := connectMongo(cfg, ctx)
+	if err != nil {
+		log.Fatal(err)
+	}
+	return co, dbOnline
+}
+
+//连接数据库，连接失败时返回错误，用于不能因为数据库不可用而退出的后台任务和历史版本查询
+func connectMongo(cfg Config, ctx context.Context) (*mongo.Client, string, error) {
 	rt := os.ExpandEnv("${RUNTIME}")
 	var clientOptions *options.ClientOptions
 	var dbOnline string
@@ -645,17 +670,18 @@ func intializeMongoOnlineClient(cfg Config, ctx context.Context) (*mongo.Client,
 	clientOptions.SetMaxPoolSize(50)
 	co, err := mongo.Connect(ctx, clientOptions)
 	if err != nil {
-		log.Fatal("momgo connect error")
+		return nil, "", fmt.Errorf("momgo connect error: %v", err)
 	}
 	err = co.Ping(ctx, nil)
 	if err != nil {
-		log.Fatal("ping mongo error")
+		co.Disconnect(ctx)
+		return nil, "", fmt.Errorf("ping mongo error: %v", err)
 	}
 	fmt.Println("Connect mongodb success")
 
 	fmt.Println(dbOnline)
 
-	return co, dbOnline
+	return co, dbOnline, nil
 }
 
 //获取目录下以××后缀的文件名（单个文件）
@@ -695,10 +721,58 @@ func getCompileCommand(m map[string]string) string {
 func getJavaPackage(m map[string]string) string {
 	return m["JavaPackage"]
 }
+func getStrict(m map[string]string) bool {
+	return m["Strict"] == "true"
+}
+func getWarning(m map[string]string) string {
+	return m["Warning"]
+}
+func getSearch(m map[string]string) bool {
+	return m["Search"] == "true"
+}
+func getCompileFlags(m map[string]string) []string {
+	return strings.Fields(m["CompileFlags"])
+}
+func getContractConfig(m map[string]string) string {
+	return m["ContractConfig"]
+}
+func getEntryFile(m map[string]string) string {
+	return m["EntryFile"]
+}
+func getContractProject(m map[string]string) string {
+	return m["ContractProject"]
+}
+func getCompileOptions(m map[string]string) string {
+	return m["CompileOptions"]
+}
 
 //监听127.0.0.1:1926端口
 func main() {
+	//在沙箱中执行编译命令，由服务进程调用
+	if len(os.Args) > 1 && os.Args[1] == "sandbox-exec" {
+		os.Exit(sandboxExec(os.Args[2:]))
+	}
 
+	//管理本地依赖镜像的命令
+	if len(os.Args) > 1 && os.Args[1] == "mirror" {
+		os.Exit(mirrorCommand(os.Args[2:]))
+	}
+	//管理编译器工具链的命令
+	if len(os.Args) > 1 && os.Args[1] == "toolchain" {
+		os.Exit(toolchainCommand(os.Args[2:]))
+	}
+	//检查编译器在不同条件下编译结果是否一致的命令
+	if len(os.Args) > 1 && os.Args[1] == "determinism" {
+		os.Exit(determinismCommand(os.Args[2:]))
+	}
+	//用测试合约检查所有编译器的命令
+	if len(os.Args) > 1 && os.Args[1] == "selftest" {
+		os.Exit(selfTestCommand(os.Args[2:]))
+	}
+	//补充记录历史区块中合约部署和更新通知的命令
+	if len(os.Args) > 1 && os.Args[1] == "watcher" {
+		os.Exit(watcherCommand(os.Args[2:]))
+	}
 	fmt.Println("Server start")
 	fmt.Println("YOUR ENV IS " + os.ExpandEnv("${RUNTIME}"))
 	//verifyNef("helloword")
@@ -707,13 +781,47 @@ func main() {
 	//verifyNef("FTWContract_debugtag")
 	//fmt.Println("VwABDANGVFdAVwABeDUGAAAAQFcAAXg1BgAAAEBXAAF4NQYAAABAVwABQFcAARhADAEA2zBBm/ZnzkGSXegxStgmBEUQ2yFAStgmBEUQ2yFAQZJd6DFAQZv2Z85AVwIBIXhwaAuXJw0AAAAR2yAjEQAAACF4StkoUMoAFLOrqiEnKAAAAAwgVGhlIGFyZ3VtZW50ICJvd25lciIgaXMgaW52YWxpZC46IUGb9mfOERGIThBR0FASwHFpeEsRzlCLUBDOQZJd6DFK2CYERRDbISMFAAAAQErZKFDKABSzq0ARiE4QUdBQEsBASxHOUItQEM5Bkl3oMUBXAwEhQZv2Z85wDAEA2zBxaWhBkl3oMUrYJgRFENshcmp4nkpyRWppaEHmPxiEQEHmPxiEQFcCAiFBm/ZnzhERiE4QUdBQEsBwaHhLEc5Qi1AQzkGSXegxStgmBEUQ2yFxaXmeSnFFaRC1Jw0AAAAQ2yAjPQAAACFpELMnGQAAAGh4SxHOUItQEM5BL1jF7SMXAAAAIWh4aRJNEc5Ri1EQzkHmPxiEIRHbICMFAAAAQEsRzlCLUBDOQS9Yxe1AEk0RzlGLURDOQeY/GIRAVwIEIXhwaAuXJw0AAAAR2yAjEQAAACF4StkoUMoAFLOrqiEnJwAAAAwfVGhlIGFyZ3VtZW50ICJmcm9tIiBpcyBpbnZhbGlkLjoheXFpC5cnDQAAABHbICMRAAAAIXlK2ShQygAUs6uqISclAAAADB1UaGUgYXJndW1lbnQgInRvIiBpcyBpbnZhbGlkLjohehC1Jy0AAAAMJVRoZSBhbW91bnQgbXVzdCBiZSBhIHBvc2l0aXZlIG51bWJlci46IXhB+CfsjKonDQAAABDbICNBAAAAIXoQmCcmAAAAIXqbeDWG/v//qicNAAAAENsgIyEAAAAhenk1cP7//0UhIXt6eXg1FAAAABHbICMFAAAAQEH4J+yMQFcCBCHCSnjPSnnPSnrPDAhUcmFuc2ZlckGVAW9heXBoC5eqJQ0AAAAQ2yAjDwAAACF5NwAAcWkLl6ohJyIAAAB7engTwB8MDm9uTkVQMTdQYXltZW50eUFifVtSRSFANwAAQEFifVtSQFcAAiF5mRC1Jw4AAAAMBmFtb3VudDoheRCzJwoAAAAjHQAAACF5eDXA/f//RXk1hP3//wt5eAs1YP///0BXAAIheZkQtScOAAAADAZhbW91bnQ6IXkQsycKAAAAIzEAAAAheZt4NYL9//+qJxEAAAAMCWV4Y2VwdGlvbjoheZs1M/3//wt5C3g1D////0BXAQIheHBoC5cnDQAAABHbICMRAAAAIXhK2ShQygAUs6uqIScnAAAADB9UaGUgYXJndW1lbnQgImZyb20iIGlzIGludmFsaWQuOiF4Qfgn7IyqJxkAAAAMEU5vIGF1dGhvcml6YXRpb24uOiF5eDVB////QFcDAiF5JwoAAAAjXAAAACE12Pv//xC3JyEAAAAMGUNvbnRyYWN0IGFscmVheSBkZXBsb3llZC46IUEtUQgwcAwB/9swcWgTzmlBm/ZnzkHmPxiEAwAAxS68orEAcmpoE841nf7//0BBLVEIMEBB5j8YhEBXAwIhDAH/2zBwaEGb9mfOQZJd6DFK2CUPAAAASsoAFCkGAAAAOiFxQS1RCDByaWoTzpclDQAAABDbICMMAAAAIWlB+CfsjCEnEgAAACELeXg3AQAhIzYAAAAhIQwrT25seSBjb250cmFjdCBvd25lciBjYW4gdXBkYXRlIHRoZSBjb250cmFjdDohIUA3AQBAVwADIQwkUGF5bWVudCBpcyBkaXNhYmxlIG9uIHRoaXMgY29udHJhY3QhOkBWAQqx+v//CoH6//8SwGBAwkpYz0o1fPr//yNu+v//wkpYz0o1bfr//yOK+v//"=="VwABDANGVFdAVwABeDUGAAAAQFcAAXg1BgAAAEBXAAF4NQYAAABAVwABQFcAARhADAEA2zBBm/ZnzkGSXegxStgmBEUQ2yFAStgmBEUQ2yFAQZJd6DFAQZv2Z85AVwIBIXhwaAuXJw0AAAAR2yAjEQAAACF4StkoUMoAFLOrqiEnKAAAAAwgVGhlIGFyZ3VtZW50ICJvd25lciIgaXMgaW52YWxpZC46IUGb9mfOERGIThBR0FASwHFpeEsRzlCLUBDOQZJd6DFK2CYERRDbISMFAAAAQErZKFDKABSzq0ARiE4QUdBQEsBASxHOUItQEM5Bkl3oMUBXAwEhQZv2Z85wDAEA2zBxaWhBkl3oMUrYJgRFENshcmp4nkpyRWppaEHmPxiEQEHmPxiEQFcCAiFBm/ZnzhERiE4QUdBQEsBwaHhLEc5Qi1AQzkGSXegxStgmBEUQ2yFxaXmeSnFFaRC1Jw0AAAAQ2yAjPQAAACFpELMnGQAAAGh4SxHOUItQEM5BL1jF7SMXAAAAIWh4aRJNEc5Ri1EQzkHmPxiEIRHbICMFAAAAQEsRzlCLUBDOQS9Yxe1AEk0RzlGLURDOQeY/GIRAVwIEIXhwaAuXJw0AAAAR2yAjEQAAACF4StkoUMoAFLOrqiEnJwAAAAwfVGhlIGFyZ3VtZW50ICJmcm9tIiBpcyBpbnZhbGlkLjoheXFpC5cnDQAAABHbICMRAAAAIXlK2ShQygAUs6uqISclAAAADB1UaGUgYXJndW1lbnQgInRvIiBpcyBpbnZhbGlkLjohehC1Jy0AAAAMJVRoZSBhbW91bnQgbXVzdCBiZSBhIHBvc2l0aXZlIG51bWJlci46IXhB+CfsjKonDQAAABDbICNBAAAAIXoQmCcmAAAAIXqbeDWG/v//qicNAAAAENsgIyEAAAAhenk1cP7//0UhIXt6eXg1FAAAABHbICMFAAAAQEH4J+yMQFcCBCHCSnjPSnnPSnrPDAhUcmFuc2ZlckGVAW9heXBoC5eqJQ0AAAAQ2yAjDwAAACF5NwAAcWkLl6ohJyIAAAB7engTwB8MDm9uTkVQMTdQYXltZW50eUFifVtSRSFANwAAQEFifVtSQFcAAiF5mRC1Jw4AAAAMBmFtb3VudDoheRCzJwoAAAAjHQAAACF5eDXA/f//RXk1hP3//wt5eAs1YP///0BXAAIheZkQtScOAAAADAZhbW91bnQ6IXkQsycKAAAAIzEAAAAheZt4NYL9//+qJxEAAAAMCWV4Y2VwdGlvbjoheZs1M/3//wt5C3g1D////0BXAQIheHBoC5cnDQAAABHbICMRAAAAIXhK2ShQygAUs6uqIScnAAAADB9UaGUgYXJndW1lbnQgImZyb20iIGlzIGludmFsaWQuOiF4Qfgn7IyqJxkAAAAMEU5vIGF1dGhvcml6YXRpb24uOiF5eDVB////QFcDAiF5JwoAAAAjXAAAACE12Pv//xC3JyEAAAAMGUNvbnRyYWN0IGFscmVheSBkZXBsb3llZC46IUEtUQgwcAwB/9swcWgTzmlBm/ZnzkHmPxiEAwAAxS68orEAcmpoE841nf7//0BBLVEIMEBB5j8YhEBXAwIhDAH/2zBwaEGb9mfOQZJd6DFK2CUPAAAASsoAFCkGAAAAOiFxQS1RCDByaWoTzpclDQAAABDbICMMAAAAIWlB+CfsjCEnEgAAACELeXg3AQAhIzYAAAAhIQwrT25seSBjb250cmFjdCBvd25lciBjYW4gdXBkYXRlIHRoZSBjb250cmFjdDohIUA3AQBAVwADIQwkUGF5bWVudCBpcyBkaXNhYmxlIG9uIHRoaXMgY29udHJhY3QhOkBWAQqx+v//CoH6//8SwGBAwkpYz0o1fPr//yNu+v//wkpYz0o1bfr//yOK+v//")
 	//fmt.Println("VwABDANGVFdAVwABeDQDQFcAAXg0A0BXAAF4NANAVwABQFcAARhADAEA2zBBm/ZnzkGSXegxStgmBEUQ2yFAStgmBEUQ2yFAQZJd6DFAQZv2Z85AVwEBeHBoC5cmBxHbICINeErZKFDKABSzq6omJQwgVGhlIGFyZ3VtZW50ICJvd25lciIgaXMgaW52YWxpZC46QZv2Z84REYhOEFHQUBLAcGh4SxHOUItQEM5Bkl3oMUrYJgRFENshIgJAStkoUMoAFLOrQBGIThBR0FASwEBLEc5Qi1AQzkGSXegxQFcDAUGb9mfOcAwBANswcWloQZJd6DFK2CYERRDbIXJqeJ5KckVqaWhB5j8YhEBB5j8YhEBXAgJBm/ZnzhERiE4QUdBQEsBwaHhLEc5Qi1AQzkGSXegxStgmBEUQ2yFxaXmeSnFFaRC1JgcQ2yAiLmkQsyYTaHhLEc5Qi1AQzkEvWMXtIhNoeGkSTRHOUYtREM5B5j8YhBHbICICQEsRzlCLUBDOQS9Yxe1AEk0RzlGLURDOQeY/GIRAVwEEeHBoC5cmBxHbICINeErZKFDKABSzq6omJAwfVGhlIGFyZ3VtZW50ICJmcm9tIiBpcyBpbnZhbGlkLjp5cGgLlyYHEdsgIg15StkoUMoAFLOrqiYiDB1UaGUgYXJndW1lbnQgInRvIiBpcyBpbnZhbGlkLjp6ELUmKgwlVGhlIGFtb3VudCBtdXN0IGJlIGEgcG9zaXRpdmUgbnVtYmVyLjp4Qfgn7IyqJgcQ2yAiKnoQmCYaept4NcH+//+qJgcQ2yAiFXp5NbL+//9Fe3p5eDQOEdsgIgJAQfgn7IxAVwEEwkp4z0p5z0p6zwwIVHJhbnNmZXJBlQFvYXlwaAuXqiQHENsgIgt5NwAAcGgLl6omH3t6eBPAHwwOb25ORVAxN1BheW1lbnR5QWJ9W1JFQDcAAEBBYn1bUkBXAAJ5mRC1JgsMBmFtb3VudDp5ELMmBCIZeXg1I/7//0V5Nej9//8LeXgLNXn///9AVwACeZkQtSYLDAZhbW91bnQ6eRCzJgQiKXmbeDXx/f//qiYODAlleGNlcHRpb246eZs1p/3//wt5C3g1OP///0BXAQJ4cGgLlyYHEdsgIg14StkoUMoAFLOrqiYkDB9UaGUgYXJndW1lbnQgImZyb20iIGlzIGludmFsaWQuOnhB+CfsjKomFgwRTm8gYXV0aG9yaXphdGlvbi46eXg1Yv///0BXAwJ5JgQiVDV1/P//ELcmHgwZQ29udHJhY3QgYWxyZWF5IGRlcGxveWVkLjpBLVEIMHAMAf/bMHFoE85pQZv2Z85B5j8YhAMAAMUuvKKxAHJqaBPONdb+//9AQS1RCDBAQeY/GIRAVwMCDAH/2zBwaEGb9mfOQZJd6DFK2CQJSsoAFCgDOnFBLVEIMHJpahPOlyQHENsgIghpQfgn7IwmCgt5eDcBACIwDCtPbmx5IGNvbnRyYWN0IG93bmVyIGNhbiB1cGRhdGUgdGhlIGNvbnRyYWN0OkA3AQBAVwADDCRQYXltZW50IGlzIGRpc2FibGUgb24gdGhpcyBjb250cmFjdCE6QFYBCm/7//8KSPv//xLAYEDCSljPSjVD+///IzX7///CSljPSjU0+///I0j7//8="=="VwABDANGVFdAVwABeDQDQFcAAXg0A0BXAAF4NANAVwABQFcAARhADAEA2zBBm/ZnzkGSXegxStgmBEUQ2yFAStgmBEUQ2yFAQZJd6DFAQZv2Z85AVwEBeHBoC5cmBxHbICINeErZKFDKABSzq6omJQwgVGhlIGFyZ3VtZW50ICJvd25lciIgaXMgaW52YWxpZC46QZv2Z84REYhOEFHQUBLAcGh4SxHOUItQEM5Bkl3oMUrYJgRFENshIgJAStkoUMoAFLOrQBGIThBR0FASwEBLEc5Qi1AQzkGSXegxQFcDAUGb9mfOcAwBANswcWloQZJd6DFK2CYERRDbIXJqeJ5KckVqaWhB5j8YhEBB5j8YhEBXAgJBm/ZnzhERiE4QUdBQEsBwaHhLEc5Qi1AQzkGSXegxStgmBEUQ2yFxaXmeSnFFaRC1JgcQ2yAiLmkQsyYTaHhLEc5Qi1AQzkEvWMXtIhNoeGkSTRHOUYtREM5B5j8YhBHbICICQEsRzlCLUBDOQS9Yxe1AEk0RzlGLURDOQeY/GIRAVwEEeHBoC5cmBxHbICINeErZKFDKABSzq6omJAwfVGhlIGFyZ3VtZW50ICJmcm9tIiBpcyBpbnZhbGlkLjp5cGgLlyYHEdsgIg15StkoUMoAFLOrqiYiDB1UaGUgYXJndW1lbnQgInRvIiBpcyBpbnZhbGlkLjp6ELUmKgwlVGhlIGFtb3VudCBtdXN0IGJlIGEgcG9zaXRpdmUgbnVtYmVyLjp4Qfgn7IyqJgcQ2yAiKnoQmCYaept4NcH+//+qJgcQ2yAiFXp5NbL+//9Fe3p5eDQOEdsgIgJAQfgn7IxAVwEEwkp4z0p5z0p6zwwIVHJhbnNmZXJBlQFvYXlwaAuXqiQHENsgIgt5NwAAcGgLl6omH3t6eBPAHwwOb25ORVAxN1BheW1lbnR5QWJ9W1JFQDcAAEBBYn1bUkBXAAJ5mRC1JgsMBmFtb3VudDp5ELMmBCIZeXg1I/7//0V5Nej9//8LeXgLNXn///9AVwACeZkQtSYLDAZhbW91bnQ6eRCzJgQiKXmbeDXx/f//qiYODAlleGNlcHRpb246eZs1p/3//wt5C3g1OP///0BXAQJ4cGgLlyYHEdsgIg14StkoUMoAFLOrqiYkDB9UaGUgYXJndW1lbnQgImZyb20iIGlzIGludmFsaWQuOnhB+CfsjKomFgwRTm8gYXV0aG9yaXphdGlvbi46eXg1Yv///0BXAwJ5JgQiVDV1/P//ELcmHgwZQ29udHJhY3QgYWxyZWF5IGRlcGxveWVkLjpBLVEIMHAMAf/bMHFoE85pQZv2Z85B5j8YhAMAAMUuvKKxAHJqaBPONdb+//9AQS1RCDBAQeY/GIRAVwMCDAH/2zBwaEGb9mfOQZJd6DFK2CQJSsoAFCgDOnFBLVEIMHJpahPOlyQHENsgIghpQfgn7IwmCgt5eDcBACIwDCtPbmx5IGNvbnRyYWN0IG93bmVyIGNhbiB1cGRhdGUgdGhlIGNvbnRyYWN0OkA3AQBAVwADDCRQYXltZW50IGlzIGRpc2FibGUgb24gdGhpcyBjb250cmFjdCE6QFYBCm/7//8KSPv//xLAYEDCSljPSjVD+///IzX7///CSljPSjU0+///I0j7//8=")
+	//加载编译器注册表
+	registry, err := loadCompilerRegistry(compilersConfigFile())
+	if err != nil {
+		log.Fatal("load compilers error: ", err)
+	}
+	compilers = registry
+	//加载编译器确定性检查的结果，标记编译结果不一致的编译器
+	determinism, err := loadDeterminism(determinismFile())
+	if err != nil {
+		log.Fatal("load determinism results error: ", err)
+	}
+	compilers.applyDeterminism(determinism)
+	//加载本地依赖镜像，镜像中的文件与锁文件中的hash不一致时不启动
+	mirrors, err = loadMirrors(mirrorDir())
+	if err != nil {
+		log.Fatal("load mirrors error: ", err)
+	}
+	if mirrors != nil {
+		err = mirrors.verify()
+		if err != nil {
+			log.Fatal("verify mirrors error: ", err)
+		}
+		fmt.Println("Use dependency mirrors in " + mirrors.Dir)
+	}
+	//检查能否创建编译使用的沙箱，不能创建时不启动，SANDBOX=off时不使用沙箱
+	err = checkSandbox()
+	if err != nil {
+		log.Fatal("sandbox error: ", err, ", please allow user namespaces or set SANDBOX=off")
+	}
+	//后台运行编译器自检，自检失败的编译器不再接受编译请求
+	startSelfTest()
+	//后台监听已验证合约的更新和销毁
+	go watchContracts()
 	mux := http.NewServeMux()
 	mux.HandleFunc("/upload", func(writer http.ResponseWriter, request *http.Request) {
 		multipleFile(writer, request)
 	})
+	mux.HandleFunc("/health", healthHandler)
 	mux.Handle("/", promhttp.Handler())
 	handler := cors.Default().Handler(mux)
-	err := http.ListenAndServe("0.0.0.0:1927", handler)
+	err = http.ListenAndServe("0.0.0.0:1927", handler)
 	if err != nil {
 		fmt.Println("listen and server error")
 	}
@@ -0,0 +1,109 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"github.com/nspcc-dev/neo-go/pkg/smartcontract/manifest"
+	"io/ioutil"
+	"os"
+)
+
+// 定义manifest比对结果，记录哪些字段一致，哪些字段不一致
+type manifestReport struct {
+	Matched    []string
+	Mismatched []string
+	Error      string
+}
+
+// 编译器没有生成manifest时的错误信息，例如neo-go没有上传合约配置文件时只生成.nef
+const manifestMissing = ".manifest.json file doesn't exist"
+
+// 读取编译器生成的manifest文件，与链上的manifest逐字段比对
+func verifyManifest(pathFile string, m map[string]string, chainManifest string) manifestReport {
+	local, err := readLocalManifest(pathFile, m)
+	if os.IsNotExist(err) {
+		fmt.Println("============.manifest.json file doesn't exist===========", err)
+		return manifestReport{Error: manifestMissing}
+	} else if err != nil {
+		return manifestReport{Error: "Failed to parse local manifest: " + err.Error()}
+	}
+	var chain manifest.Manifest
+	err = json.Unmarshal([]byte(chainManifest), &chain)
+	if err != nil {
+		return manifestReport{Error: "Failed to parse chain manifest: " + err.Error()}
+	}
+	return compareManifest(local, &chain)
+}
+
+// 读取编译器生成的manifest文件
+func readLocalManifest(pathFile string, m map[string]string) (*manifest.Manifest, error) {
+	dir, file := getOutputPath(pathFile, m)
+	f, err := ioutil.ReadFile(dir + file + ".manifest.json")
+	if err != nil {
+		return nil, err
+	}
+	local := new(manifest.Manifest)
+	err = json.Unmarshal(f, local)
+	if err != nil {
+		return nil, err
+	}
+	return local, nil
+}
+
+// 逐字段比对两个manifest，字段按json序列化之后的结果比较
+func compareManifest(local *manifest.Manifest, chain *manifest.Manifest) manifestReport {
+	report := manifestReport{Matched: []string{}, Mismatched: []string{}}
+	fields := []struct {
+		name  string
+		local interface{}
+		chain interface{}
+	}{
+		{"name", local.Name, chain.Name},
+		{"groups", local.Groups, chain.Groups},
+		{"features", local.Features, chain.Features},
+		{"supportedstandards", local.SupportedStandards, chain.SupportedStandards},
+		{"abi", local.ABI, chain.ABI},
+		{"permissions", local.Permissions, chain.Permissions},
+		{"trusts", local.Trusts, chain.Trusts},
+		{"extra", local.Extra, chain.Extra},
+	}
+	for _, field := range fields {
+		if jsonEqual(field.local, field.chain) {
+			report.Matched = append(report.Matched, field.name)
+		} else {
+			report.Mismatched = append(report.Mismatched, field.name)
+		}
+	}
+	fmt.Println("Manifest matched fields:", report.Matched, "mismatched fields:", report.Mismatched)
+	return report
+}
+
+// 比较两个值序列化为json之后是否相等，空的RawMessage与null视为相等
+func jsonEqual(a interface{}, b interface{}) bool {
+	ja, err := normalizeJSON(a)
+	if err != nil {
+		return false
+	}
+	jb, err := normalizeJSON(b)
+	if err != nil {
+		return false
+	}
+	return bytes.Equal(ja, jb)
+}
+
+func normalizeJSON(v interface{}) ([]byte, error) {
+	if raw, ok := v.(json.RawMessage); ok {
+		if len(raw) == 0 {
+			return []byte("null"), nil
+		}
+		//重新序列化一次，消除空白和key顺序的差异
+		var obj interface{}
+		err := json.Unmarshal(raw, &obj)
+		if err != nil {
+			return nil, err
+		}
+		return json.Marshal(obj)
+	}
+	return json.Marshal(v)
+}
@@ -0,0 +1,285 @@
+package main
+
+import (
+	"archive/zip"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/nspcc-dev/neo-go/pkg/smartcontract/manifest"
+	"github.com/nspcc-dev/neo-go/pkg/vm/opcode"
+	"io/ioutil"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// 定义按方法比对的结果
+type methodReport struct {
+	Matched    []string
+	Mismatched []string
+	DebugInfo  bool
+	Error      string `json:",omitempty"`
+}
+
+// 定义script中一个方法所占的范围[Start, End)
+type methodRange struct {
+	Key   string
+	Name  string
+	Start int
+	End   int
+}
+
+// 定义debug info中的方法范围，End为方法最后一条指令的offset
+type debugMethod struct {
+	Start int
+	End   int
+}
+
+// 根据manifest中ABI方法的offset，把本地和链上的script切分成方法，逐个方法比对
+func verifyMethods(pathFile string, m map[string]string, localScript string, state contractState) methodReport {
+	report := methodReport{Matched: []string{}, Mismatched: []string{}}
+	local, err := base64.StdEncoding.DecodeString(localScript)
+	if err != nil {
+		report.Error = "Failed to decode local script: " + err.Error()
+		return report
+	}
+	chain, err := base64.StdEncoding.DecodeString(state.Script)
+	if err != nil {
+		report.Error = "Failed to decode chain script: " + err.Error()
+		return report
+	}
+	chainManifest := new(manifest.Manifest)
+	err = json.Unmarshal([]byte(state.Manifest), chainManifest)
+	if err != nil {
+		report.Error = "Failed to parse chain manifest: " + err.Error()
+		return report
+	}
+	//本地没有生成manifest时，假设本地方法的offset与链上一致
+	localManifest, err := readLocalManifest(pathFile, m)
+	if err != nil {
+		localManifest = chainManifest
+	}
+	localIns, err := disassemble(local)
+	if err != nil {
+		report.Error = "Local script: " + err.Error()
+		return report
+	}
+	chainIns, err := disassemble(chain)
+	if err != nil {
+		report.Error = "Chain script: " + err.Error()
+		return report
+	}
+	localRanges := methodRanges(localManifest, len(local))
+	chainRanges := methodRanges(chainManifest, len(chain))
+	//有debug info时，用debug info中的方法范围修正本地方法的结束位置，
+	//链上方法的范围始终按链上ABI的offset确定，方法本身和之后到下一个ABI方法之间的代码（私有方法）分别比对
+	debug, err := readDebugInfo(pathFile, m)
+	report.DebugInfo = err == nil && len(debug) != 0
+	refined := refineRanges(localRanges, debug, localIns)
+
+	chainByKey := make(map[string]methodRange)
+	for _, r := range chainRanges {
+		chainByKey[r.Key] = r
+	}
+	seen := make(map[string]bool)
+	for i, lr := range refined {
+		seen[lr.Key] = true
+		cr, ok := chainByKey[lr.Key]
+		if !ok {
+			report.Mismatched = append(report.Mismatched, lr.Name)
+			continue
+		}
+		var matched bool
+		if report.DebugInfo {
+			matched = splitRangesMatch(localIns, lr, localRanges[i].End, localRanges, chainIns, cr, chainRanges)
+		} else {
+			matched = rangesMatch(localIns, lr, localRanges, chainIns, cr, chainRanges)
+		}
+		if matched {
+			report.Matched = append(report.Matched, lr.Name)
+		} else {
+			report.Mismatched = append(report.Mismatched, lr.Name)
+		}
+	}
+	for _, cr := range chainRanges {
+		if !seen[cr.Key] {
+			report.Mismatched = append(report.Mismatched, cr.Name)
+		}
+	}
+	fmt.Println("Matched methods:", report.Matched, "mismatched methods:", report.Mismatched)
+	return report
+}
+
+func rangesMatch(localIns []instruction, lr methodRange, localRanges []methodRange, chainIns []instruction, cr methodRange, chainRanges []methodRange) bool {
+	l := normalizeMethod(localIns, lr, localRanges)
+	c := normalizeMethod(chainIns, cr, chainRanges)
+	return strings.Join(l, "\n") == strings.Join(c, "\n")
+}
+
+// 本地方法lr在debug info中的范围之后到end为止是私有方法。链上方法cr的开头与lr比对，
+// 剩余部分与本地的私有方法比对，链上方法比本地多出的指令视为不匹配
+func splitRangesMatch(localIns []instruction, lr methodRange, end int, localRanges []methodRange, chainIns []instruction, cr methodRange, chainRanges []methodRange) bool {
+	head := cr
+	head.End = cr.Start + lr.End - lr.Start
+	if head.End > cr.End {
+		return false
+	}
+	localTail := methodRange{Key: lr.Key, Name: lr.Name, Start: lr.End, End: end}
+	chainTail := methodRange{Key: cr.Key, Name: cr.Name, Start: head.End, End: cr.End}
+	return rangesMatch(localIns, lr, localRanges, chainIns, head, chainRanges) &&
+		rangesMatch(localIns, localTail, localRanges, chainIns, chainTail, chainRanges)
+}
+
+// 按ABI中方法的offset切分script，每个方法的范围到下一个offset更大的方法为止
+func methodRanges(m *manifest.Manifest, size int) []methodRange {
+	ranges := []methodRange{}
+	for _, method := range m.ABI.Methods {
+		key := method.Name + "/" + strconv.Itoa(len(method.Parameters))
+		ranges = append(ranges, methodRange{Key: key, Name: method.Name, Start: method.Offset, End: size})
+	}
+	sort.SliceStable(ranges, func(i, j int) bool { return ranges[i].Start < ranges[j].Start })
+	for i := range ranges {
+		for j := i + 1; j < len(ranges); j++ {
+			if ranges[j].Start > ranges[i].Start {
+				ranges[i].End = ranges[j].Start
+				break
+			}
+		}
+	}
+	return ranges
+}
+
+// 用debug info中起始位置相同的方法修正方法的结束位置
+func refineRanges(ranges []methodRange, debug []debugMethod, ins []instruction) []methodRange {
+	res := make([]methodRange, len(ranges))
+	copy(res, ranges)
+	for i := range res {
+		for _, d := range debug {
+			if d.Start != res[i].Start {
+				continue
+			}
+			//debug info中的结束位置是最后一条指令的offset，换算成下一条指令的offset
+			for k, in := range ins {
+				if in.Offset == d.End {
+					if k+1 < len(ins) {
+						res[i].End = ins[k+1].Offset
+					}
+					break
+				}
+			}
+			break
+		}
+	}
+	return res
+}
+
+// 将方法范围内的指令转换成可比较的形式，跳转和调用的目标换算成相对方法起始位置的偏移或者目标方法名
+func normalizeMethod(ins []instruction, r methodRange, all []methodRange) []string {
+	res := []string{}
+	for _, in := range ins {
+		if in.Offset < r.Start || in.Offset >= r.End {
+			continue
+		}
+		targets := jumpTargets(in)
+		if targets == nil {
+			res = append(res, in.Opcode+" "+in.Operand)
+			continue
+		}
+		desc := []string{}
+		for _, t := range targets {
+			desc = append(desc, describeTarget(t, r, all))
+		}
+		res = append(res, in.Opcode+" "+strings.Join(desc, ","))
+	}
+	return res
+}
+
+// 返回跳转、调用类指令的目标offset，其它指令返回nil
+func jumpTargets(in instruction) []int {
+	op, err := opcode.FromString(in.Opcode)
+	if err != nil {
+		return nil
+	}
+	param, _ := hex.DecodeString(in.Operand)
+	switch op {
+	case opcode.JMP, opcode.JMPIF, opcode.JMPIFNOT, opcode.JMPEQ, opcode.JMPNE,
+		opcode.JMPGT, opcode.JMPGE, opcode.JMPLT, opcode.JMPLE,
+		opcode.CALL, opcode.ENDTRY:
+		return []int{in.Offset + int(int8(param[0]))}
+	case opcode.JMPL, opcode.JMPIFL, opcode.JMPIFNOTL, opcode.JMPEQL, opcode.JMPNEL,
+		opcode.JMPGTL, opcode.JMPGEL, opcode.JMPLTL, opcode.JMPLEL,
+		opcode.CALLL, opcode.ENDTRYL, opcode.PUSHA:
+		return []int{in.Offset + int(int32(binary.LittleEndian.Uint32(param)))}
+	case opcode.TRY:
+		return []int{in.Offset + int(int8(param[0])), in.Offset + int(int8(param[1]))}
+	case opcode.TRYL:
+		return []int{in.Offset + int(int32(binary.LittleEndian.Uint32(param[:4]))), in.Offset + int(int32(binary.LittleEndian.Uint32(param[4:])))}
+	}
+	return nil
+}
+
+// 方法内部的目标用相对偏移表示，方法外部的目标用所在方法名加偏移表示
+func describeTarget(target int, r methodRange, all []methodRange) string {
+	if target >= r.Start && target < r.End {
+		return "+" + strconv.Itoa(target-r.Start)
+	}
+	for _, o := range all {
+		if target >= o.Start && target < o.End {
+			return o.Key + "+" + strconv.Itoa(target-o.Start)
+		}
+	}
+	return "?"
+}
+
+// 读取编译器生成的debug info，支持.nefdbgnfo压缩包和.debug.json文件
+func readDebugInfo(pathFile string, m map[string]string) ([]debugMethod, error) {
+	dir, file := getOutputPath(pathFile, m)
+	var data []byte
+	zr, err := zip.OpenReader(dir + file + ".nefdbgnfo")
+	if err == nil {
+		defer zr.Close()
+		if len(zr.File) == 0 {
+			return nil, errors.New("empty .nefdbgnfo file")
+		}
+		rc, err := zr.File[0].Open()
+		if err != nil {
+			return nil, err
+		}
+		defer rc.Close()
+		data, err = ioutil.ReadAll(rc)
+		if err != nil {
+			return nil, err
+		}
+	} else {
+		data, err = ioutil.ReadFile(dir + file + ".debug.json")
+		if err != nil {
+			return nil, err
+		}
+	}
+	var info struct {
+		Methods []struct {
+			Range string `json:"range"`
+		} `json:"methods"`
+	}
+	err = json.Unmarshal(data, &info)
+	if err != nil {
+		return nil, err
+	}
+	res := []debugMethod{}
+	for _, method := range info.Methods {
+		bounds := strings.Split(method.Range, "-")
+		if len(bounds) != 2 {
+			continue
+		}
+		start, err1 := strconv.Atoi(bounds[0])
+		end, err2 := strconv.Atoi(bounds[1])
+		if err1 != nil || err2 != nil {
+			continue
+		}
+		res = append(res, debugMethod{start, end})
+	}
+	return res, nil
+}
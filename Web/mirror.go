@@ -0,0 +1,1132 @@
+package main
+
+import (
+	"archive/zip"
+	"bytes"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"gopkg.in/yaml.v3"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"os/exec"
+	"path"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+	"unicode"
+)
+
+// 定义镜像中的一个文件，Path为相对于镜像目录的路径
+type mirrorFile struct {
+	Path   string `yaml:"path"`
+	Sha256 string `yaml:"sha256"`
+}
+
+// 定义镜像中的一个依赖包，Ecosystem为nuget、maven、pypi或go
+type mirrorPackage struct {
+	Ecosystem string       `yaml:"ecosystem"`
+	Name      string       `yaml:"name"`
+	Version   string       `yaml:"version"`
+	Files     []mirrorFile `yaml:"files"`
+}
+
+// 定义镜像目录以及记录所有依赖包和hash的锁文件
+type mirrorStore struct {
+	Dir      string          `yaml:"-"`
+	Packages []mirrorPackage `yaml:"packages"`
+	// go模块的go.sum记录，添加模块时由go命令对照sum.golang.org校验，编译时用来校验从镜像下载的模块
+	GoSum []string `yaml:"gosum,omitempty"`
+
+	// 上次校验通过时文件的大小和修改时间，编译前只重新计算发生变化的文件的hash
+	mu       sync.Mutex
+	verified map[string]mirrorStamp
+}
+
+type mirrorStamp struct {
+	size    int64
+	modTime time.Time
+}
+
+// 锁文件名，保存在镜像目录中
+const mirrorLockFile = "mirrors.yml"
+
+// 编译语言使用的镜像
+var mirrorEcosystems = map[string]string{
+	"csharp": "nuget",
+	"java":   "maven",
+	"python": "pypi",
+	"go":     "go",
+}
+
+// 下载时仓库返回404
+var errMirrorNotFound = errors.New("not found")
+
+// 启动时加载的本地镜像，没有锁文件时为nil，编译时使用公共仓库
+var mirrors *mirrorStore
+
+// 镜像目录，可以通过MIRROR_DIR环境变量指定
+func mirrorDir() string {
+	if d := os.Getenv("MIRROR_DIR"); d != "" {
+		return d
+	}
+	return "/go/application/mirrors"
+}
+
+// 读取镜像目录中的锁文件，锁文件不存在时返回nil
+func loadMirrors(dir string) (*mirrorStore, error) {
+	dir, err := filepath.Abs(dir)
+	if err != nil {
+		return nil, err
+	}
+	data, err := ioutil.ReadFile(filepath.Join(dir, mirrorLockFile))
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	store := &mirrorStore{}
+	err = yaml.Unmarshal(data, store)
+	if err != nil {
+		return nil, err
+	}
+	store.Dir = dir
+	return store, nil
+}
+
+func (s *mirrorStore) save() error {
+	data, err := yaml.Marshal(s)
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(filepath.Join(s.Dir, mirrorLockFile), data, 0666)
+}
+
+// 检查镜像中所有文件的hash是否与锁文件一致
+func (s *mirrorStore) verify() error {
+	return s.verifyFiles("", true)
+}
+
+// 检查一种镜像（为空时检查全部）中文件的hash，force为false时跳过大小和修改时间与上次校验通过时相同的文件
+func (s *mirrorStore) verifyFiles(ecosystem string, force bool) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.verified == nil {
+		s.verified = map[string]mirrorStamp{}
+	}
+	for _, p := range s.Packages {
+		if ecosystem != "" && p.Ecosystem != ecosystem {
+			continue
+		}
+		for _, f := range p.Files {
+			file := filepath.Join(s.Dir, f.Path)
+			info, err := os.Stat(file)
+			if err != nil {
+				return err
+			}
+			stamp := mirrorStamp{size: info.Size(), modTime: info.ModTime()}
+			if !force && s.verified[f.Path] == stamp {
+				continue
+			}
+			sum, err := fileSha256(file)
+			if err != nil {
+				return err
+			}
+			if sum != f.Sha256 {
+				delete(s.verified, f.Path)
+				return fmt.Errorf("%s %s %s: hash of %s is %s, expected %s", p.Ecosystem, p.Name, p.Version, f.Path, sum, f.Sha256)
+			}
+			s.verified[f.Path] = stamp
+		}
+	}
+	return nil
+}
+
+// 根据编译语言让编译命令只使用本地镜像中的依赖，使用前重新检查该语言的镜像文件
+func (s *mirrorStore) apply(cmd *exec.Cmd, language string) error {
+	if s == nil {
+		return nil
+	}
+	if ecosystem, ok := mirrorEcosystems[language]; ok {
+		err := s.verifyFiles(ecosystem, false)
+		if err != nil {
+			return err
+		}
+	}
+	env := os.Environ()
+	switch language {
+	case "csharp":
+		//NuGet.Config放在镜像目录中，通过RestoreConfigFile属性（MSBuild会读取同名的环境变量）指定，
+		//不写入上传目录，不会覆盖用户上传的文件，也不会作为源代码保存
+		config, err := s.nugetConfig()
+		if err != nil {
+			return err
+		}
+		env = append(env, "RestoreConfigFile="+config)
+	case "java":
+		env = append(env, "MAVEN_MIRROR=file://"+filepath.Join(s.Dir, "maven"))
+	case "python":
+		//neo3-boa工具链的setup命令通过pip安装依赖
+		env = append(env, "PIP_NO_INDEX=1", "PIP_FIND_LINKS="+filepath.Join(s.Dir, "pypi"))
+	case "go":
+		//不关闭go.sum校验：goExec.sh生成go.mod时使用镜像中的go.sum，上传了go.mod时按上传的go.sum只读校验，
+		//两者中都没有记录的模块需要访问sum.golang.org，沙箱中没有网络，编译失败
+		sum, err := s.goSum()
+		if err != nil {
+			return err
+		}
+		env = append(env, "GOPROXY=file://"+filepath.Join(s.Dir, "go"), "GOSUMDB=sum.golang.org", "GONOSUMDB=", "GOPRIVATE=", "GOINSECURE=", "MIRROR_GOSUM="+sum)
+	}
+	cmd.Env = env
+	return nil
+}
+
+// 在镜像目录中生成只使用本地nuget镜像的NuGet.Config，返回文件路径
+func (s *mirrorStore) nugetConfig() (string, error) {
+	file := filepath.Join(s.Dir, "NuGet.Config")
+	config := `<?xml version="1.0" encoding="utf-8"?>
+<configuration>
+  <packageSources>
+    <clear />
+    <add key="mirror" value="` + filepath.Join(s.Dir, "nuget") + `" />
+  </packageSources>
+</configuration>
+`
+	data, err := ioutil.ReadFile(file)
+	if err == nil && string(data) == config {
+		return file, nil
+	}
+	return file, ioutil.WriteFile(file, []byte(config), 0666)
+}
+
+// 根据锁文件在镜像目录中生成go.sum，返回文件路径，文件被修改时按锁文件重新生成
+func (s *mirrorStore) goSum() (string, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	file := filepath.Join(s.Dir, "go.sum")
+	sum := strings.Join(s.GoSum, "\n") + "\n"
+	data, err := ioutil.ReadFile(file)
+	if err == nil && string(data) == sum {
+		return file, nil
+	}
+	return file, ioutil.WriteFile(file, []byte(sum), 0666)
+}
+
+// 下载依赖包及其全部传递依赖并记录hash，已经存在的文件不会重复下载，返回新增或增加了文件的包
+func (s *mirrorStore) add(ecosystem string, name string, version string) ([]mirrorPackage, error) {
+	var added []mirrorPackage
+	var err error
+	switch ecosystem {
+	case "nuget":
+		added, err = s.addNuget(name, version)
+	case "maven":
+		added, err = s.addMaven(name, version)
+	case "gradle-plugin":
+		//gradle插件通过标记构件<id>:<id>.gradle.plugin解析，标记构件的依赖为插件的实现
+		added, err = s.addMaven(name+":"+name+".gradle.plugin", version)
+	case "pypi":
+		added, err = s.addPypi(name, version)
+	case "go":
+		added, err = s.addGo(name, version)
+	default:
+		err = errors.New("unknown ecosystem " + ecosystem + ", please choose one of: nuget, maven, gradle-plugin, pypi, go")
+	}
+	if err != nil {
+		return nil, err
+	}
+	return added, s.save()
+}
+
+// 在锁文件中记录文件，包不存在时新建，返回包是否有变化；同一个文件的hash与已记录的不同时返回错误
+func (s *mirrorStore) record(ecosystem string, name string, version string, f mirrorFile) (bool, error) {
+	for i := range s.Packages {
+		p := &s.Packages[i]
+		if p.Ecosystem != ecosystem || p.Name != name || p.Version != version {
+			continue
+		}
+		for _, old := range p.Files {
+			if old.Path == f.Path {
+				if old.Sha256 != f.Sha256 {
+					return false, fmt.Errorf("%s %s %s: hash of %s is %s, expected %s", ecosystem, name, version, f.Path, f.Sha256, old.Sha256)
+				}
+				return false, nil
+			}
+		}
+		p.Files = append(p.Files, f)
+		return true, nil
+	}
+	s.Packages = append(s.Packages, mirrorPackage{Ecosystem: ecosystem, Name: name, Version: version, Files: []mirrorFile{f}})
+	return true, nil
+}
+
+// 锁文件中已经记录的文件，没有记录时返回false
+func (s *mirrorStore) recorded(file string) (mirrorFile, bool) {
+	for _, p := range s.Packages {
+		for _, f := range p.Files {
+			if f.Path == file {
+				return f, true
+			}
+		}
+	}
+	return mirrorFile{}, false
+}
+
+// 读取锁文件中已经记录的文件，hash与记录的不一致时返回错误
+func (s *mirrorStore) readRecorded(f mirrorFile) ([]byte, error) {
+	data, err := ioutil.ReadFile(filepath.Join(s.Dir, filepath.FromSlash(f.Path)))
+	if err != nil {
+		return nil, err
+	}
+	h := sha256.Sum256(data)
+	if sum := hex.EncodeToString(h[:]); sum != f.Sha256 {
+		return nil, fmt.Errorf("hash of %s is %s, expected %s", f.Path, sum, f.Sha256)
+	}
+	return data, nil
+}
+
+// 按名称和版本返回锁文件中的包，用于输出新增的包
+func (s *mirrorStore) packages(keys []string) []mirrorPackage {
+	var list []mirrorPackage
+	seen := map[string]bool{}
+	for _, key := range keys {
+		if seen[key] {
+			continue
+		}
+		seen[key] = true
+		for _, p := range s.Packages {
+			if p.Ecosystem+" "+p.Name+" "+p.Version == key {
+				list = append(list, p)
+				break
+			}
+		}
+	}
+	return list
+}
+
+// nuget镜像为只包含.nupkg文件的本地目录。依赖从.nuspec中解析（包括所有目标框架的依赖），版本范围取最低版本，
+// 与NuGet默认选择的版本一致；每个包的SHA512需要与nuget.org目录中公布的packageHash一致
+func (s *mirrorStore) addNuget(name string, version string) ([]mirrorPackage, error) {
+	var changed []string
+	queue := [][2]string{{name, version}}
+	seen := map[string]bool{}
+	for len(queue) > 0 {
+		id := strings.ToLower(queue[0][0])
+		v, err := normalizeNugetVersion(queue[0][1])
+		queue = queue[1:]
+		if err != nil {
+			return nil, fmt.Errorf("nuget %s: %v", id, err)
+		}
+		if seen[id+" "+v] {
+			continue
+		}
+		seen[id+" "+v] = true
+		file := "nuget/" + id + "." + v + ".nupkg"
+		var data []byte
+		if f, ok := s.recorded(file); ok {
+			data, err = s.readRecorded(f)
+			if err != nil {
+				return nil, err
+			}
+		} else {
+			data, err = mirrorFetch("https://api.nuget.org/v3-flatcontainer/" + id + "/" + v + "/" + id + "." + v + ".nupkg")
+			if err != nil {
+				return nil, err
+			}
+			expected, err := nugetPackageHash(id, v)
+			if err != nil {
+				return nil, err
+			}
+			h := sha512.Sum512(data)
+			if sum := base64.StdEncoding.EncodeToString(h[:]); sum != expected {
+				return nil, fmt.Errorf("nuget %s %s: SHA512 is %s, nuget.org published %s", id, v, sum, expected)
+			}
+			f, err := s.store(file, data)
+			if err != nil {
+				return nil, err
+			}
+			_, err = s.record("nuget", id, v, f)
+			if err != nil {
+				return nil, err
+			}
+			changed = append(changed, "nuget "+id+" "+v)
+		}
+		deps, err := nuspecDependencies(data)
+		if err != nil {
+			return nil, fmt.Errorf("nuget %s %s: %v", id, v, err)
+		}
+		for _, d := range deps {
+			lowest, err := nugetLowestVersion(d.Version)
+			if err != nil {
+				return nil, fmt.Errorf("nuget %s %s: dependency %s: %v", id, v, d.ID, err)
+			}
+			queue = append(queue, [2]string{d.ID, lowest})
+		}
+	}
+	return s.packages(changed), nil
+}
+
+type nuspecDependency struct {
+	ID      string `xml:"id,attr"`
+	Version string `xml:"version,attr"`
+}
+
+// 读取.nupkg中.nuspec声明的依赖，包括所有目标框架分组中的依赖
+func nuspecDependencies(nupkg []byte) ([]nuspecDependency, error) {
+	r, err := zip.NewReader(bytes.NewReader(nupkg), int64(len(nupkg)))
+	if err != nil {
+		return nil, err
+	}
+	for _, f := range r.File {
+		if strings.Contains(f.Name, "/") || !strings.HasSuffix(strings.ToLower(f.Name), ".nuspec") {
+			continue
+		}
+		rc, err := f.Open()
+		if err != nil {
+			return nil, err
+		}
+		var spec struct {
+			Dependencies []nuspecDependency `xml:"metadata>dependencies>dependency"`
+			Groups       []struct {
+				Dependencies []nuspecDependency `xml:"dependency"`
+			} `xml:"metadata>dependencies>group"`
+		}
+		err = xml.NewDecoder(rc).Decode(&spec)
+		rc.Close()
+		if err != nil {
+			return nil, err
+		}
+		deps := spec.Dependencies
+		for _, g := range spec.Groups {
+			deps = append(deps, g.Dependencies...)
+		}
+		return deps, nil
+	}
+	return nil, errors.New("no .nuspec in package")
+}
+
+// nuget.org目录中公布的包的SHA512（base64）
+func nugetPackageHash(id string, version string) (string, error) {
+	var leaf struct {
+		CatalogEntry string `json:"catalogEntry"`
+	}
+	err := mirrorFetchJSON("https://api.nuget.org/v3/registration5-gz-semver2/"+id+"/"+version+".json", &leaf)
+	if err != nil {
+		return "", err
+	}
+	var entry struct {
+		PackageHash          string `json:"packageHash"`
+		PackageHashAlgorithm string `json:"packageHashAlgorithm"`
+	}
+	err = mirrorFetchJSON(leaf.CatalogEntry, &entry)
+	if err != nil {
+		return "", err
+	}
+	if entry.PackageHashAlgorithm != "SHA512" || entry.PackageHash == "" {
+		return "", fmt.Errorf("nuget %s %s: catalog has no SHA512 package hash", id, version)
+	}
+	return entry.PackageHash, nil
+}
+
+// 按NuGet的规则规范化版本号：去掉元数据，至少三段，第四段为0时去掉，转换为小写
+func normalizeNugetVersion(version string) (string, error) {
+	v := strings.ToLower(strings.TrimSpace(version))
+	if i := strings.Index(v, "+"); i >= 0 {
+		v = v[:i]
+	}
+	release := ""
+	if i := strings.Index(v, "-"); i >= 0 {
+		v, release = v[:i], v[i:]
+	}
+	parts := strings.Split(v, ".")
+	if len(parts) > 4 {
+		return "", errors.New("invalid version " + version)
+	}
+	for len(parts) < 3 {
+		parts = append(parts, "0")
+	}
+	for i, p := range parts {
+		n, err := strconv.Atoi(p)
+		if err != nil || n < 0 {
+			return "", errors.New("invalid version " + version)
+		}
+		parts[i] = strconv.Itoa(n)
+	}
+	if len(parts) == 4 && parts[3] == "0" {
+		parts = parts[:3]
+	}
+	return strings.Join(parts, ".") + release, nil
+}
+
+// 依赖版本范围的最低版本，不支持没有下限或不包含下限的范围
+func nugetLowestVersion(r string) (string, error) {
+	r = strings.TrimSpace(r)
+	if r == "" {
+		return "", errors.New("dependency without version, please add it explicitly")
+	}
+	if strings.HasPrefix(r, "(") {
+		return "", errors.New("unsupported version range " + r)
+	}
+	if strings.HasPrefix(r, "[") {
+		lower := strings.TrimSpace(strings.TrimRight(strings.SplitN(r[1:], ",", 2)[0], "]"))
+		if lower == "" {
+			return "", errors.New("unsupported version range " + r)
+		}
+		return lower, nil
+	}
+	return r, nil
+}
+
+// maven镜像使用maven仓库的目录结构，name为group:artifact，在maven中央仓库中找不到时从gradle插件仓库下载。
+// 依赖从pom中解析：包括父pom、import的BOM以及compile和runtime范围的非可选依赖，同一个构件出现的所有版本都会下载；
+// 依赖的exclusions和profiles不处理，只会多下载；每个文件的sha1需要与仓库公布的一致
+func (s *mirrorStore) addMaven(name string, version string) ([]mirrorPackage, error) {
+	coords := strings.Split(name, ":")
+	if len(coords) != 2 {
+		return nil, errors.New("maven package name must be group:artifact")
+	}
+	r := &mavenResolver{store: s, poms: map[string]*mavenPom{}}
+	queue := []mavenDependency{{GroupID: coords[0], ArtifactID: coords[1], Version: version}}
+	seen := map[string]bool{}
+	for len(queue) > 0 {
+		d := queue[0]
+		queue = queue[1:]
+		key := d.GroupID + ":" + d.ArtifactID + ":" + d.Version + ":" + d.Classifier + ":" + d.Type
+		if seen[key] {
+			continue
+		}
+		seen[key] = true
+		p, err := r.load(d.GroupID, d.ArtifactID, d.Version)
+		if err != nil {
+			return nil, err
+		}
+		base := d.ArtifactID + "-" + d.Version
+		if p.Packaging != "pom" && d.Type != "pom" {
+			jar := base + ".jar"
+			if d.Classifier != "" {
+				jar = base + "-" + d.Classifier + ".jar"
+			}
+			_, err = r.artifact(d.GroupID, d.ArtifactID, d.Version, jar)
+			if err != nil {
+				return nil, err
+			}
+		}
+		//gradle优先使用.module中的元数据，仓库中没有时只使用pom
+		_, err = r.artifact(d.GroupID, d.ArtifactID, d.Version, base+".module")
+		if err != nil && !errors.Is(err, errMirrorNotFound) {
+			return nil, err
+		}
+		for _, dep := range p.deps {
+			dep, ok, err := p.dependency(dep)
+			if err != nil {
+				return nil, fmt.Errorf("maven %s:%s:%s: %v", d.GroupID, d.ArtifactID, d.Version, err)
+			}
+			if ok {
+				queue = append(queue, dep)
+			}
+		}
+	}
+	return s.packages(r.changed), nil
+}
+
+// maven仓库，按顺序查找
+var mavenRepositories = []string{"https://repo1.maven.org/maven2/", "https://plugins.gradle.org/m2/"}
+
+type mavenDependency struct {
+	GroupID    string `xml:"groupId"`
+	ArtifactID string `xml:"artifactId"`
+	Version    string `xml:"version"`
+	Type       string `xml:"type"`
+	Classifier string `xml:"classifier"`
+	Scope      string `xml:"scope"`
+	Optional   string `xml:"optional"`
+}
+
+type mavenPom struct {
+	GroupID    string `xml:"groupId"`
+	ArtifactID string `xml:"artifactId"`
+	Version    string `xml:"version"`
+	Packaging  string `xml:"packaging"`
+	Parent     struct {
+		GroupID    string `xml:"groupId"`
+		ArtifactID string `xml:"artifactId"`
+		Version    string `xml:"version"`
+	} `xml:"parent"`
+	Properties struct {
+		Entries []struct {
+			XMLName xml.Name
+			Value   string `xml:",chardata"`
+		} `xml:",any"`
+	} `xml:"properties"`
+	Managed      []mavenDependency `xml:"dependencyManagement>dependencies>dependency"`
+	Dependencies []mavenDependency `xml:"dependencies>dependency"`
+
+	// 合并父pom之后的属性、依赖管理（按优先级排列）和依赖
+	props   map[string]string
+	managed []mavenDependency
+	deps    []mavenDependency
+}
+
+var mavenProperty = regexp.MustCompile(`\$\{([^}]+)\}`)
+
+// 替换${...}属性，没有定义的属性保持不变
+func (p *mavenPom) interpolate(v string) string {
+	for i := 0; i < 10 && strings.Contains(v, "${"); i++ {
+		v = mavenProperty.ReplaceAllStringFunc(v, func(m string) string {
+			if value, ok := p.props[m[2:len(m)-1]]; ok {
+				return value
+			}
+			return m
+		})
+	}
+	return strings.TrimSpace(v)
+}
+
+// 解析依赖的坐标、范围和版本，返回false表示不需要镜像（test、provided、system范围或可选依赖）
+func (p *mavenPom) dependency(d mavenDependency) (mavenDependency, bool, error) {
+	d.GroupID = p.interpolate(d.GroupID)
+	d.ArtifactID = p.interpolate(d.ArtifactID)
+	d.Version = p.interpolate(d.Version)
+	d.Scope = p.interpolate(d.Scope)
+	d.Type = p.interpolate(d.Type)
+	d.Classifier = p.interpolate(d.Classifier)
+	for _, m := range p.managed {
+		if p.interpolate(m.GroupID) != d.GroupID || p.interpolate(m.ArtifactID) != d.ArtifactID {
+			continue
+		}
+		if d.Version == "" {
+			d.Version = p.interpolate(m.Version)
+		}
+		if d.Scope == "" {
+			d.Scope = p.interpolate(m.Scope)
+		}
+		break
+	}
+	if d.Scope != "" && d.Scope != "compile" && d.Scope != "runtime" || p.interpolate(d.Optional) == "true" {
+		return d, false, nil
+	}
+	//[x]为固定版本，其它版本范围需要解析仓库中的版本列表，不支持
+	if strings.HasPrefix(d.Version, "[") && strings.HasSuffix(d.Version, "]") && !strings.Contains(d.Version, ",") {
+		d.Version = strings.TrimSpace(d.Version[1 : len(d.Version)-1])
+	}
+	if d.Version == "" || strings.Contains(d.Version, "${") || strings.ContainsAny(d.Version, "[](),") {
+		return d, false, fmt.Errorf("cannot resolve version %q of %s:%s, please add it explicitly", d.Version, d.GroupID, d.ArtifactID)
+	}
+	return d, true, nil
+}
+
+type mavenResolver struct {
+	store   *mirrorStore
+	poms    map[string]*mavenPom
+	changed []string
+}
+
+// 读取pom以及它的父pom和import的BOM，合并属性、依赖管理和依赖
+func (r *mavenResolver) load(group string, artifact string, version string) (*mavenPom, error) {
+	key := group + ":" + artifact + ":" + version
+	if p, ok := r.poms[key]; ok {
+		return p, nil
+	}
+	data, err := r.artifact(group, artifact, version, artifact+"-"+version+".pom")
+	if err != nil {
+		return nil, err
+	}
+	p := &mavenPom{}
+	err = xml.Unmarshal(data, p)
+	if err != nil {
+		return nil, fmt.Errorf("maven %s: %v", key, err)
+	}
+	p.props = map[string]string{}
+	var parent *mavenPom
+	if p.Parent.ArtifactID != "" {
+		parent, err = r.load(p.Parent.GroupID, p.Parent.ArtifactID, p.Parent.Version)
+		if err != nil {
+			return nil, err
+		}
+		for k, v := range parent.props {
+			p.props[k] = v
+		}
+		if p.GroupID == "" {
+			p.GroupID = p.Parent.GroupID
+		}
+		if p.Version == "" {
+			p.Version = p.Parent.Version
+		}
+		p.props["project.parent.groupId"] = p.Parent.GroupID
+		p.props["project.parent.version"] = p.Parent.Version
+	}
+	for _, e := range p.Properties.Entries {
+		p.props[e.XMLName.Local] = strings.TrimSpace(e.Value)
+	}
+	for _, prefix := range []string{"project.", "pom.", ""} {
+		p.props[prefix+"groupId"] = p.GroupID
+		p.props[prefix+"artifactId"] = p.ArtifactID
+		p.props[prefix+"version"] = p.Version
+	}
+	//依赖管理的优先级：自己声明的、按顺序import的BOM、父pom
+	var imports []mavenDependency
+	for _, m := range p.Managed {
+		if p.interpolate(m.Scope) != "import" {
+			p.managed = append(p.managed, m)
+			continue
+		}
+		bom, err := r.load(p.interpolate(m.GroupID), p.interpolate(m.ArtifactID), p.interpolate(m.Version))
+		if err != nil {
+			return nil, err
+		}
+		for _, b := range bom.managed {
+			b.GroupID, b.ArtifactID, b.Version, b.Scope = bom.interpolate(b.GroupID), bom.interpolate(b.ArtifactID), bom.interpolate(b.Version), bom.interpolate(b.Scope)
+			imports = append(imports, b)
+		}
+	}
+	p.managed = append(p.managed, imports...)
+	p.deps = p.Dependencies
+	if parent != nil {
+		p.managed = append(p.managed, parent.managed...)
+		p.deps = append(p.deps, parent.deps...)
+	}
+	r.poms[key] = p
+	return p, nil
+}
+
+// 下载构件中的一个文件并检查仓库公布的sha1，已经在锁文件中的文件从镜像读取；所有仓库中都没有时返回errMirrorNotFound
+func (r *mavenResolver) artifact(group string, artifact string, version string, name string) ([]byte, error) {
+	dir := strings.ReplaceAll(group, ".", "/") + "/" + artifact + "/" + version + "/"
+	file := "maven/" + dir + name
+	if f, ok := r.store.recorded(file); ok {
+		return r.store.readRecorded(f)
+	}
+	var lastErr error
+	for _, repo := range mavenRepositories {
+		data, err := mirrorFetch(repo + dir + name)
+		if errors.Is(err, errMirrorNotFound) {
+			lastErr = err
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		sha, err := mirrorFetch(repo + dir + name + ".sha1")
+		if err != nil {
+			return nil, err
+		}
+		h := sha1.Sum(data)
+		sum := hex.EncodeToString(h[:])
+		if fields := strings.Fields(string(sha)); len(fields) == 0 || !strings.EqualFold(fields[0], sum) {
+			return nil, fmt.Errorf("download %s: sha1 is %s, repository published %s", repo+dir+name, sum, strings.TrimSpace(string(sha)))
+		}
+		f, err := r.store.store(file, data)
+		if err != nil {
+			return nil, err
+		}
+		changed, err := r.store.record("maven", group+":"+artifact, version, f)
+		if err != nil {
+			return nil, err
+		}
+		if changed {
+			r.changed = append(r.changed, "maven "+group+":"+artifact+" "+version)
+		}
+		return data, nil
+	}
+	return nil, lastErr
+}
+
+// pypi镜像为pip --find-links使用的目录。依赖由pip解析并下载（MIRROR_PYTHON指定运行pip的python，默认为python3，
+// 需要与工具链使用的python版本一致），每个文件的sha256需要与PyPI为该版本公布的一致
+func (s *mirrorStore) addPypi(name string, version string) ([]mirrorPackage, error) {
+	tmp, err := ioutil.TempDir("", "mirror-pypi-")
+	if err != nil {
+		return nil, err
+	}
+	defer os.RemoveAll(tmp)
+	python := os.Getenv("MIRROR_PYTHON")
+	if python == "" {
+		python = "python3"
+	}
+	cmd := exec.Command(python, "-m", "pip", "download", "--no-cache-dir", "--dest", tmp, name+"=="+version)
+	//不使用编译时的pip镜像配置
+	for _, e := range os.Environ() {
+		if !strings.HasPrefix(e, "PIP_") {
+			cmd.Env = append(cmd.Env, e)
+		}
+	}
+	out, err := cmd.CombinedOutput()
+	if err != nil {
+		return nil, fmt.Errorf("pip download %s==%s: %v\n%s", name, version, err, out)
+	}
+	files, err := ioutil.ReadDir(tmp)
+	if err != nil {
+		return nil, err
+	}
+	var changed []string
+	for _, info := range files {
+		project, v, err := parseDistFilename(info.Name())
+		if err != nil {
+			return nil, err
+		}
+		data, err := ioutil.ReadFile(filepath.Join(tmp, info.Name()))
+		if err != nil {
+			return nil, err
+		}
+		digests, err := pypiDigests(project, v)
+		if err != nil {
+			return nil, err
+		}
+		h := sha256.Sum256(data)
+		sum := hex.EncodeToString(h[:])
+		if digests[info.Name()] != sum {
+			return nil, fmt.Errorf("pypi %s %s: hash of %s is %s, PyPI published %q", project, v, info.Name(), sum, digests[info.Name()])
+		}
+		f, err := s.store("pypi/"+info.Name(), data)
+		if err != nil {
+			return nil, err
+		}
+		ok, err := s.record("pypi", project, v, f)
+		if err != nil {
+			return nil, err
+		}
+		if ok {
+			changed = append(changed, "pypi "+project+" "+v)
+		}
+	}
+	return s.packages(changed), nil
+}
+
+// PyPI为一个版本公布的所有文件的sha256
+func pypiDigests(name string, version string) (map[string]string, error) {
+	var info struct {
+		Urls []struct {
+			Filename string `json:"filename"`
+			Digests  struct {
+				Sha256 string `json:"sha256"`
+			} `json:"digests"`
+		} `json:"urls"`
+	}
+	err := mirrorFetchJSON("https://pypi.org/pypi/"+name+"/"+version+"/json", &info)
+	if err != nil {
+		return nil, err
+	}
+	digests := map[string]string{}
+	for _, u := range info.Urls {
+		digests[u.Filename] = u.Digests.Sha256
+	}
+	return digests, nil
+}
+
+// 从wheel或源码包的文件名中解析包名和版本
+func parseDistFilename(file string) (string, string, error) {
+	if strings.HasSuffix(file, ".whl") {
+		parts := strings.Split(file, "-")
+		if len(parts) >= 5 {
+			return parts[0], parts[1], nil
+		}
+	}
+	for _, ext := range []string{".tar.gz", ".tar.bz2", ".zip"} {
+		if base := strings.TrimSuffix(file, ext); base != file {
+			if i := strings.LastIndex(base, "-"); i > 0 {
+				return base[:i], base[i+1:], nil
+			}
+		}
+	}
+	return "", "", errors.New("cannot parse distribution file name " + file)
+}
+
+// go镜像使用GOPROXY的目录结构，可以通过file://访问。依赖闭包由go命令解析和下载，下载的模块和go.mod由go命令
+// 对照sum.golang.org校验；镜像保存解析过程中下载的所有模块文件（包括只用于版本选择的go.mod），校验过的记录合并到GoSum中
+func (s *mirrorStore) addGo(name string, version string) ([]mirrorPackage, error) {
+	tmp, err := ioutil.TempDir("", "mirror-go-")
+	if err != nil {
+		return nil, err
+	}
+	defer os.RemoveAll(tmp)
+	cache := filepath.Join(tmp, "cache")
+	env := append(os.Environ(), "GO111MODULE=on", "GOMODCACHE="+cache, "GOPROXY=https://proxy.golang.org", "GOSUMDB=sum.golang.org", "GONOSUMDB=", "GOPRIVATE=", "GOINSECURE=", "GOFLAGS=-mod=mod")
+	run := func(args ...string) ([]byte, error) {
+		cmd := exec.Command("go", args...)
+		cmd.Dir = tmp
+		cmd.Env = env
+		var stderr bytes.Buffer
+		cmd.Stderr = &stderr
+		out, err := cmd.Output()
+		if err != nil {
+			return nil, fmt.Errorf("go %s: %v\n%s", strings.Join(args, " "), err, stderr.String())
+		}
+		return out, nil
+	}
+	//模块缓存中的文件是只读的，删除临时目录前先清理
+	defer run("clean", "-modcache")
+	err = ioutil.WriteFile(filepath.Join(tmp, "go.mod"), []byte("module mirror\n"), 0666)
+	if err != nil {
+		return nil, err
+	}
+	_, err = run("get", "-d", name+"@"+version)
+	if err != nil {
+		return nil, err
+	}
+	out, err := run("mod", "download", "-json", "all")
+	if err != nil {
+		return nil, err
+	}
+	sums := map[string]bool{}
+	for _, line := range s.GoSum {
+		sums[line] = true
+	}
+	data, err := ioutil.ReadFile(filepath.Join(tmp, "go.sum"))
+	if err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+	for _, line := range strings.Split(string(data), "\n") {
+		if line = strings.TrimSpace(line); line != "" {
+			sums[line] = true
+		}
+	}
+	dec := json.NewDecoder(bytes.NewReader(out))
+	for dec.More() {
+		var m struct {
+			Path     string
+			Version  string
+			Error    string
+			Sum      string
+			GoModSum string
+		}
+		err = dec.Decode(&m)
+		if err != nil {
+			return nil, err
+		}
+		if m.Error != "" {
+			return nil, fmt.Errorf("go %s %s: %s", m.Path, m.Version, m.Error)
+		}
+		if m.Sum != "" {
+			sums[m.Path+" "+m.Version+" "+m.Sum] = true
+		}
+		if m.GoModSum != "" {
+			sums[m.Path+" "+m.Version+"/go.mod "+m.GoModSum] = true
+		}
+	}
+	root := filepath.Join(cache, "cache", "download")
+	var changed []string
+	versions := map[string][]string{}
+	err = filepath.Walk(root, func(file string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(root, file)
+		if err != nil {
+			return err
+		}
+		rel = filepath.ToSlash(rel)
+		if info.IsDir() {
+			if rel == "sumdb" {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		i := strings.LastIndex(rel, "/@v/")
+		ext := path.Ext(rel)
+		if i < 0 || ext != ".info" && ext != ".mod" && ext != ".zip" {
+			return nil
+		}
+		data, err := ioutil.ReadFile(file)
+		if err != nil {
+			return err
+		}
+		f, err := s.store("go/"+rel, data)
+		if err != nil {
+			return err
+		}
+		module := unescapeModulePath(rel[:i])
+		v := unescapeModulePath(strings.TrimSuffix(rel[i+len("/@v/"):], ext))
+		ok, err := s.record("go", module, v, f)
+		if err != nil {
+			return err
+		}
+		if ok {
+			changed = append(changed, "go "+module+" "+v)
+		}
+		if ext == ".info" {
+			versions[rel[:i]] = append(versions[rel[:i]], strings.TrimSuffix(rel[i+len("/@v/"):], ext))
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	for module, vs := range versions {
+		err = addGoVersions(filepath.Join(s.Dir, "go", filepath.FromSlash(module), "@v", "list"), vs)
+		if err != nil {
+			return nil, err
+		}
+	}
+	s.GoSum = s.GoSum[:0]
+	for line := range sums {
+		s.GoSum = append(s.GoSum, line)
+	}
+	sort.Strings(s.GoSum)
+	return s.packages(changed), nil
+}
+
+// 把版本加入GOPROXY的版本列表，已经存在的版本不重复添加
+func addGoVersions(list string, versions []string) error {
+	data, _ := ioutil.ReadFile(list)
+	existing := map[string]bool{}
+	for _, v := range strings.Fields(string(data)) {
+		existing[v] = true
+	}
+	for _, v := range versions {
+		if !existing[v] {
+			existing[v] = true
+			data = append(data, []byte(v+"\n")...)
+		}
+	}
+	return ioutil.WriteFile(list, data, 0666)
+}
+
+// 下载url的内容，仓库返回404时错误包含errMirrorNotFound
+func mirrorFetch(url string) ([]byte, error) {
+	resp, err := http.Get(url)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode == http.StatusNotFound {
+		return nil, fmt.Errorf("download %s: %w", url, errMirrorNotFound)
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("download %s: %s", url, resp.Status)
+	}
+	data, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+	fmt.Println("Mirror: downloaded " + url)
+	return data, nil
+}
+
+func mirrorFetchJSON(url string, v interface{}) error {
+	data, err := mirrorFetch(url)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(data, v)
+}
+
+// 把文件写入镜像目录并计算sha256，已经在锁文件中的文件不会被覆盖
+func (s *mirrorStore) store(file string, data []byte) (mirrorFile, error) {
+	h := sha256.Sum256(data)
+	if f, ok := s.recorded(path.Clean(file)); ok {
+		if f.Sha256 != hex.EncodeToString(h[:]) {
+			return mirrorFile{}, fmt.Errorf("hash of %s is %s, expected %s", f.Path, hex.EncodeToString(h[:]), f.Sha256)
+		}
+		return f, nil
+	}
+	dst := filepath.Join(s.Dir, filepath.FromSlash(file))
+	err := os.MkdirAll(filepath.Dir(dst), 0777)
+	if err != nil {
+		return mirrorFile{}, err
+	}
+	err = ioutil.WriteFile(dst, data, 0666)
+	if err != nil {
+		return mirrorFile{}, err
+	}
+	return mirrorFile{Path: path.Clean(file), Sha256: hex.EncodeToString(h[:])}, nil
+}
+
+// 按GOPROXY协议还原转义的模块路径，!加小写字母转换成大写字母
+func unescapeModulePath(escaped string) string {
+	var b strings.Builder
+	upper := false
+	for _, r := range escaped {
+		if r == '!' {
+			upper = true
+			continue
+		}
+		if upper {
+			r = unicode.ToUpper(r)
+			upper = false
+		}
+		b.WriteRune(r)
+	}
+	return b.String()
+}
+
+func fileSha256(file string) (string, error) {
+	f, err := os.Open(file)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	h := sha256.New()
+	_, err = io.Copy(h, f)
+	if err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// 管理本地镜像的命令，add会下载包的全部传递依赖：
+//
+//	mirror add <nuget|maven|gradle-plugin|pypi|go> <name> <version>
+//	mirror list
+//	mirror verify
+func mirrorCommand(args []string) int {
+	store, err := loadMirrors(mirrorDir())
+	if err != nil {
+		fmt.Println(err)
+		return 1
+	}
+	if store == nil {
+		dir, _ := filepath.Abs(mirrorDir())
+		store = &mirrorStore{Dir: dir}
+	}
+	if len(args) == 4 && args[0] == "add" {
+		err = os.MkdirAll(store.Dir, 0777)
+		if err != nil {
+			fmt.Println(err)
+			return 1
+		}
+		added, err := store.add(args[1], args[2], args[3])
+		if err != nil {
+			fmt.Println(err)
+			return 1
+		}
+		for _, p := range added {
+			fmt.Println(p.Ecosystem + " " + p.Name + " " + p.Version)
+			for _, f := range p.Files {
+				fmt.Println("  " + f.Sha256 + "  " + f.Path)
+			}
+		}
+		if len(added) == 0 {
+			fmt.Println("All files are already mirrored")
+		}
+		return 0
+	}
+	if len(args) == 1 && args[0] == "list" {
+		for _, p := range store.Packages {
+			fmt.Println(p.Ecosystem + " " + p.Name + " " + p.Version)
+		}
+		return 0
+	}
+	if len(args) == 1 && args[0] == "verify" {
+		err = store.verify()
+		if err != nil {
+			fmt.Println(err)
+			return 1
+		}
+		fmt.Println("All mirrored packages match their pinned hashes")
+		return 0
+	}
+	fmt.Println("usage: mirror add <nuget|maven|gradle-plugin|pypi|go> <name> <version> | mirror list | mirror verify")
+	return 2
+}
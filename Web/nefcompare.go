@@ -0,0 +1,86 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/nspcc-dev/neo-go/pkg/smartcontract/nef"
+	"io/ioutil"
+	"strconv"
+)
+
+// 定义nef严格比对结果，记录所有不一致的字段
+type nefReport struct {
+	Strict     bool
+	Mismatched []string
+	Error      string
+}
+
+// 读取本地编译生成的.nef文件
+func readLocalNef(pathFile string, m map[string]string) (nef.File, error) {
+	dir, file := getOutputPath(pathFile, m)
+	f, err := ioutil.ReadFile(dir + file + ".nef")
+	if err != nil {
+		return nef.File{}, err
+	}
+	return nef.FileFromBytes(f)
+}
+
+// 将本地编译的nef与链上的nef逐字段比对，包括method tokens、compiler、source和checksum
+func verifyNefFields(pathFile string, m map[string]string, chainNef string) nefReport {
+	report := nefReport{Strict: getStrict(m), Mismatched: []string{}}
+	local, err := readLocalNef(pathFile, m)
+	if err != nil {
+		report.Error = "Failed to read local nef: " + err.Error()
+		return report
+	}
+	var chain nef.File
+	err = json.Unmarshal([]byte(chainNef), &chain)
+	if err != nil {
+		report.Error = "Failed to parse chain nef: " + err.Error()
+		return report
+	}
+	report.Mismatched = compareNef(&local, &chain)
+	fmt.Println("Nef mismatched fields:", report.Mismatched)
+	return report
+}
+
+// 逐字段比对两个nef，返回不一致的字段名
+func compareNef(local *nef.File, chain *nef.File) []string {
+	mismatched := []string{}
+	if local.Compiler != chain.Compiler {
+		mismatched = append(mismatched, "compiler")
+	}
+	if local.Source != chain.Source {
+		mismatched = append(mismatched, "source")
+	}
+	if len(local.Tokens) != len(chain.Tokens) {
+		mismatched = append(mismatched, "tokens")
+	} else {
+		for i := range local.Tokens {
+			prefix := "tokens[" + strconv.Itoa(i) + "]."
+			l, c := local.Tokens[i], chain.Tokens[i]
+			if !l.Hash.Equals(c.Hash) {
+				mismatched = append(mismatched, prefix+"hash")
+			}
+			if l.Method != c.Method {
+				mismatched = append(mismatched, prefix+"method")
+			}
+			if l.ParamCount != c.ParamCount {
+				mismatched = append(mismatched, prefix+"paramcount")
+			}
+			if l.HasReturn != c.HasReturn {
+				mismatched = append(mismatched, prefix+"hasreturnvalue")
+			}
+			if l.CallFlag != c.CallFlag {
+				mismatched = append(mismatched, prefix+"callflags")
+			}
+		}
+	}
+	if string(local.Script) != string(chain.Script) {
+		mismatched = append(mismatched, "script")
+	}
+	if local.Checksum != chain.Checksum {
+		mismatched = append(mismatched, "checksum")
+	}
+	return mismatched
+}
@@ -0,0 +1,235 @@
+package main
+
+import (
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"github.com/nspcc-dev/neo-go/pkg/vm"
+	"strings"
+)
+
+// 对齐比较的最大指令数量，对齐的时间与两边指令数量的乘积成正比，超过之后按位置逐条比较
+const maxAlignInstructions = 4000
+
+// 差异列表最多返回的条数
+const maxDiffEntries = 200
+
+// 定义反汇编之后的一条指令
+type instruction struct {
+	Offset  int
+	Opcode  string
+	Operand string
+}
+
+// 定义对齐之后的一条差异，Op为changed、removed或added，removed表示只存在于本地，added表示只存在于链上
+type diffEntry struct {
+	Op    string
+	Local *instruction `json:",omitempty"`
+	Chain *instruction `json:",omitempty"`
+}
+
+// 定义第一条不一致指令的位置
+type divergence struct {
+	Index       int
+	LocalOffset int
+	ChainOffset int
+}
+
+// 定义本地script与链上script的指令级差异
+type opcodeDiff struct {
+	LocalSize         int
+	ChainSize         int
+	SizeDelta         int
+	LocalInstructions int
+	ChainInstructions int
+	FirstDivergence   *divergence `json:",omitempty"`
+	Entries           []diffEntry
+	Truncated         bool
+	Error             string `json:",omitempty"`
+}
+
+// 反汇编script，返回指令列表
+func disassemble(script []byte) ([]instruction, error) {
+	ctx := vm.NewContext(script)
+	res := []instruction{}
+	for ctx.NextIP() < len(script) {
+		op, param, err := ctx.Next()
+		if err != nil {
+			return res, fmt.Errorf("failed to disassemble at offset %d: %w", ctx.IP(), err)
+		}
+		res = append(res, instruction{ctx.IP(), op.String(), hex.EncodeToString(param)})
+	}
+	return res, nil
+}
+
+// 比较本地编译的script与链上的script（均为base64编码），返回指令级差异
+func diffScripts(localScript string, chainScript string) opcodeDiff {
+	result := opcodeDiff{Entries: []diffEntry{}}
+	local, err := base64.StdEncoding.DecodeString(localScript)
+	if err != nil {
+		result.Error = "Failed to decode local script: " + err.Error()
+		return result
+	}
+	chain, err := base64.StdEncoding.DecodeString(chainScript)
+	if err != nil {
+		result.Error = "Failed to decode chain script: " + err.Error()
+		return result
+	}
+	result.LocalSize = len(local)
+	result.ChainSize = len(chain)
+	result.SizeDelta = len(local) - len(chain)
+	//两边的反汇编错误都要报告
+	var errs []string
+	localIns, err := disassemble(local)
+	if err != nil {
+		errs = append(errs, "Local script: "+err.Error())
+	}
+	chainIns, err := disassemble(chain)
+	if err != nil {
+		errs = append(errs, "Chain script: "+err.Error())
+	}
+	result.Error = strings.Join(errs, "; ")
+	result.LocalInstructions = len(localIns)
+	result.ChainInstructions = len(chainIns)
+	for i, e := range alignInstructions(localIns, chainIns) {
+		if e.Op == "" {
+			continue
+		}
+		if result.FirstDivergence == nil {
+			result.FirstDivergence = &divergence{Index: i, LocalOffset: -1, ChainOffset: -1}
+			if e.Local != nil {
+				result.FirstDivergence.LocalOffset = e.Local.Offset
+			}
+			if e.Chain != nil {
+				result.FirstDivergence.ChainOffset = e.Chain.Offset
+			}
+		}
+		if len(result.Entries) == maxDiffEntries {
+			result.Truncated = true
+			break
+		}
+		result.Entries = append(result.Entries, e)
+	}
+	return result
+}
+
+// 按操作码对齐两组指令（最长公共子序列），操作码相同但操作数不同的指令标记为changed，相同的指令Op为空
+func alignInstructions(local []instruction, chain []instruction) []diffEntry {
+	res := []diffEntry{}
+	//去掉相同的前缀和后缀，只对中间部分做对齐
+	start := 0
+	for start < len(local) && start < len(chain) && local[start].Opcode == chain[start].Opcode {
+		res = append(res, pairInstructions(&local[start], &chain[start]))
+		start++
+	}
+	endL, endC := len(local), len(chain)
+	for endL > start && endC > start && local[endL-1].Opcode == chain[endC-1].Opcode {
+		endL--
+		endC--
+	}
+	l, c := local[start:endL], chain[start:endC]
+	if len(l) > maxAlignInstructions || len(c) > maxAlignInstructions {
+		//指令过多时按位置逐条比较
+		for i := 0; i < len(l) || i < len(c); i++ {
+			switch {
+			case i < len(l) && i < len(c):
+				e := pairInstructions(&l[i], &c[i])
+				if l[i].Opcode != c[i].Opcode {
+					e.Op = "changed"
+				}
+				res = append(res, e)
+			case i < len(l):
+				res = append(res, diffEntry{Op: "removed", Local: &l[i]})
+			default:
+				res = append(res, diffEntry{Op: "added", Chain: &c[i]})
+			}
+		}
+	} else {
+		res = alignLCS(l, c, res)
+	}
+	for i := endL; i < len(local); i++ {
+		res = append(res, pairInstructions(&local[i], &chain[endC+i-endL]))
+	}
+	return res
+}
+
+// 用Hirschberg算法按操作码求最长公共子序列并把对齐结果追加到res，只保存两行长度，内存与指令数量成线性关系
+func alignLCS(l []instruction, c []instruction, res []diffEntry) []diffEntry {
+	switch {
+	case len(l) == 0:
+		for j := range c {
+			res = append(res, diffEntry{Op: "added", Chain: &c[j]})
+		}
+		return res
+	case len(c) == 0:
+		for i := range l {
+			res = append(res, diffEntry{Op: "removed", Local: &l[i]})
+		}
+		return res
+	case len(l) == 1:
+		for j := range c {
+			if c[j].Opcode == l[0].Opcode {
+				res = alignLCS(nil, c[:j], res)
+				res = append(res, pairInstructions(&l[0], &c[j]))
+				return alignLCS(nil, c[j+1:], res)
+			}
+		}
+		res = append(res, diffEntry{Op: "removed", Local: &l[0]})
+		return alignLCS(nil, c, res)
+	}
+	//forward[j]为l前半部分与c[:j]的LCS长度，backward[j]为l后半部分与c[j:]的LCS长度，取和最大的位置拆分c
+	mid := len(l) / 2
+	forward := lcsLengths(l[:mid], c, false)
+	backward := lcsLengths(l[mid:], c, true)
+	split := 0
+	for j := range forward {
+		if forward[j]+backward[j] > forward[split]+backward[split] {
+			split = j
+		}
+	}
+	res = alignLCS(l[:mid], c[:split], res)
+	return alignLCS(l[mid:], c[split:], res)
+}
+
+// 计算l与c的每个前缀（reverse为true时为每个后缀）的LCS长度，下标为前缀长度（后缀起点）
+func lcsLengths(l []instruction, c []instruction, reverse bool) []int32 {
+	prev := make([]int32, len(c)+1)
+	cur := make([]int32, len(c)+1)
+	for k := range l {
+		if !reverse {
+			i := k
+			cur[0] = 0
+			for j := 1; j <= len(c); j++ {
+				if l[i].Opcode == c[j-1].Opcode {
+					cur[j] = prev[j-1] + 1
+				} else if prev[j] >= cur[j-1] {
+					cur[j] = prev[j]
+				} else {
+					cur[j] = cur[j-1]
+				}
+			}
+		} else {
+			i := len(l) - 1 - k
+			cur[len(c)] = 0
+			for j := len(c) - 1; j >= 0; j-- {
+				if l[i].Opcode == c[j].Opcode {
+					cur[j] = prev[j+1] + 1
+				} else if prev[j] >= cur[j+1] {
+					cur[j] = prev[j]
+				} else {
+					cur[j] = cur[j+1]
+				}
+			}
+		}
+		prev, cur = cur, prev
+	}
+	return prev
+}
+
+func pairInstructions(local *instruction, chain *instruction) diffEntry {
+	e := diffEntry{Local: local, Chain: chain}
+	if local.Operand != chain.Operand {
+		e.Op = "changed"
+	}
+	return e
+}
@@ -0,0 +1,154 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"strconv"
+	"strings"
+)
+
+// 定义编译器允许的一个编译选项，Type为bool、enum、int或string，enum的取值范围为Values
+type optionSchema struct {
+	Name   string   `yaml:"name"`
+	Type   string   `yaml:"type"`
+	Values []string `yaml:"values"`
+}
+
+// 校验之后的编译选项，bool类型的Value为空
+type compileOption struct {
+	Name  string
+	Value string `bson:",omitempty"`
+}
+
+// 转换成命令行参数
+func (o compileOption) args() []string {
+	if o.Value == "" {
+		return []string{o.Name}
+	}
+	return []string{o.Name, o.Value}
+}
+
+// 从CompileCommand、CompileFlags和CompileOptions字段中解析编译选项并按schema校验，
+// CompileCommand开头的编译器名称（如nccs）会被忽略，CompileOptions为{"--optimize":"All"}形式的json，
+// 同一个选项指定多次时后面的值生效，返回的选项按schema中的顺序排列
+func parseOptions(compiler string, schema []optionSchema, m map[string]string) ([]compileOption, error) {
+	tokens := strings.Fields(getCompileCommand(m))
+	if len(tokens) > 0 && !strings.HasPrefix(tokens[0], "-") {
+		tokens = tokens[1:]
+	}
+	tokens = append(tokens, getCompileFlags(m)...)
+	values := map[string]string{}
+	set := func(name string, value string) {
+		values[name] = value
+	}
+	for i := 0; i < len(tokens); i++ {
+		name := tokens[i]
+		value := ""
+		hasValue := false
+		if j := strings.Index(name, "="); j >= 0 {
+			name, value, hasValue = name[:j], name[j+1:], true
+		}
+		s, ok := findOption(schema, name)
+		if !ok {
+			return nil, unknownOption(compiler, schema, name)
+		}
+		if s.Type != "bool" && !hasValue {
+			if i+1 >= len(tokens) {
+				return nil, errors.New("Compile option " + name + " requires a value")
+			}
+			i++
+			value = tokens[i]
+		}
+		set(name, value)
+	}
+	if getCompileOptions(m) != "" {
+		var extra map[string]interface{}
+		err := json.Unmarshal([]byte(getCompileOptions(m)), &extra)
+		if err != nil {
+			return nil, errors.New("CompileOptions must be a json object: " + err.Error())
+		}
+		for name, v := range extra {
+			s, ok := findOption(schema, name)
+			if !ok {
+				return nil, unknownOption(compiler, schema, name)
+			}
+			switch v := v.(type) {
+			case bool:
+				if s.Type != "bool" {
+					return nil, errors.New("Compile option " + name + " requires a value")
+				}
+				if v {
+					set(name, "")
+				} else {
+					delete(values, name)
+				}
+			case float64:
+				set(name, strconv.FormatFloat(v, 'f', -1, 64))
+			case string:
+				set(name, v)
+			default:
+				return nil, errors.New("Invalid value for compile option " + name)
+			}
+		}
+	}
+	options := []compileOption{}
+	for _, s := range schema {
+		value, ok := values[s.Name]
+		if !ok {
+			continue
+		}
+		err := s.check(value)
+		if err != nil {
+			return nil, err
+		}
+		options = append(options, compileOption{Name: s.Name, Value: value})
+	}
+	return options, nil
+}
+
+func findOption(schema []optionSchema, name string) (optionSchema, bool) {
+	for _, s := range schema {
+		if s.Name == name {
+			return s, true
+		}
+	}
+	return optionSchema{}, false
+}
+
+func unknownOption(compiler string, schema []optionSchema, name string) error {
+	if len(schema) == 0 {
+		return errors.New("Compile options aren't supported by " + compiler)
+	}
+	names := []string{}
+	for _, s := range schema {
+		names = append(names, s.Name)
+	}
+	return errors.New("Unknown compile option " + name + " for " + compiler + ", please choose from: " + strings.Join(names, ", "))
+}
+
+// 检查选项的取值是否符合类型
+func (s optionSchema) check(value string) error {
+	switch s.Type {
+	case "bool":
+		if value != "" {
+			return errors.New("Compile option " + s.Name + " doesn't take a value")
+		}
+	case "enum":
+		for _, v := range s.Values {
+			if v == value {
+				return nil
+			}
+		}
+		return errors.New("Invalid value " + value + " for compile option " + s.Name + ", please choose from: " + strings.Join(s.Values, ", "))
+	case "int":
+		_, err := strconv.Atoi(value)
+		if err != nil {
+			return errors.New("Compile option " + s.Name + " requires an integer value")
+		}
+	case "string":
+		if value == "" || strings.HasPrefix(value, "-") {
+			return errors.New("Compile option " + s.Name + " requires a value")
+		}
+	}
+	return nil
+}
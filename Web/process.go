@@ -0,0 +1,118 @@
+package main
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"syscall"
+	"time"
+)
+
+// 编译超时或者被取消时返回的错误码
+const compileTimeoutCode = "10"
+
+// 编译命令输出中保留的最大字节数
+const maxCompileOutput = 64 << 10
+
+// 定义编译命令的输出，只保留最后maxCompileOutput字节
+type compileOutput struct {
+	Stdout string
+	Stderr string
+}
+
+// 编译超时或者请求被取消
+type timeoutError struct {
+	timeout   time.Duration
+	cancelled bool
+}
+
+func (e *timeoutError) Error() string {
+	if e.cancelled {
+		return "Compilation was cancelled"
+	}
+	return "Compilation timed out after " + e.timeout.String()
+}
+
+// 默认的编译超时时间，可以通过COMPILE_TIMEOUT环境变量指定，例如15m
+func defaultCompileTimeout() time.Duration {
+	d, err := time.ParseDuration(os.Getenv("COMPILE_TIMEOUT"))
+	if err != nil || d <= 0 {
+		return 10 * time.Minute
+	}
+	return d
+}
+
+// 在沙箱中运行编译命令并等待结束，超过编译器的超时时间或者ctx被取消时结束整个进程组。
+// 输出写入临时文件而不是管道，避免遗留的子进程占用管道导致一直等待
+func runCompiler(ctx context.Context, c Compiler, cmd *exec.Cmd) (compileOutput, error) {
+	output := compileOutput{}
+	sandbox, err := sandboxCommand(cmd)
+	if err != nil {
+		return output, err
+	}
+	defer sandbox.cleanup()
+	stdout, err := ioutil.TempFile("", "compile-stdout-")
+	if err != nil {
+		return output, err
+	}
+	defer os.Remove(stdout.Name())
+	defer stdout.Close()
+	stderr, err := ioutil.TempFile("", "compile-stderr-")
+	if err != nil {
+		return output, err
+	}
+	defer os.Remove(stderr.Name())
+	defer stderr.Close()
+	cmd.Stdout = stdout
+	cmd.Stderr = stderr
+	if cmd.SysProcAttr == nil {
+		cmd.SysProcAttr = &syscall.SysProcAttr{}
+	}
+	cmd.SysProcAttr.Setpgid = true
+	ctx, cancel := context.WithTimeout(ctx, c.Timeout())
+	defer cancel()
+	err = cmd.Start()
+	if err != nil {
+		return output, err
+	}
+	done := make(chan struct{})
+	go func() {
+		select {
+		case <-ctx.Done():
+			syscall.Kill(-cmd.Process.Pid, syscall.SIGKILL)
+		case <-done:
+		}
+	}()
+	err = cmd.Wait()
+	close(done)
+	//结束编译命令遗留在进程组中的子进程，例如gradle daemon
+	syscall.Kill(-cmd.Process.Pid, syscall.SIGKILL)
+	output.Stdout = readTail(stdout.Name(), maxCompileOutput)
+	output.Stderr = readTail(stderr.Name(), maxCompileOutput)
+	if err != nil && ctx.Err() != nil {
+		return output, &timeoutError{timeout: c.Timeout(), cancelled: ctx.Err() == context.Canceled}
+	}
+	if violation := sandbox.violation(); violation != nil {
+		return output, violation
+	}
+	return output, err
+}
+
+// 读取文件最后max字节
+func readTail(file string, max int64) string {
+	f, err := os.Open(file)
+	if err != nil {
+		return ""
+	}
+	defer f.Close()
+	info, err := f.Stat()
+	if err != nil {
+		return ""
+	}
+	if info.Size() > max {
+		f.Seek(info.Size()-max, 0)
+	}
+	data, _ := ioutil.ReadAll(f)
+	return string(data)
+}
@@ -1,98 +1,13 @@
 #!/bin/bash
+#参数依次为neo3-boa所在的虚拟环境目录和入口文件（相对于上传目录的路径），由compilers.yml配置
 echo you env is $1
 
-if [ $1 == "boa113" ]
+if [ ! -f $1/bin/activate ]
 then
-  source /go/application/venv113/bin/activate
-  neo3-boa *.py
-  deactivate
+  echo virtual environment $1 doesn\'t exist
+  exit 1
 fi
 
-if [ $1 == "boa112" ]
-then
-  source /go/application/venv112/bin/activate
-  neo3-boa *.py
-  deactivate
-fi
-
-if [ $1 == "boa111" ]
-then
-  source /go/application/venv111/bin/activate
-  neo3-boa *.py
-  deactivate
-fi
-
-if [ $1 == "boa110" ]
-then
-  source /go/application/venv110/bin/activate
-  neo3-boa *.py
-  deactivate
-fi
-
-if [ $1 == "boa101" ]
-then
-  source /go/application/venv101/bin/activate
-  neo3-boa *.py
-  deactivate
-fi
-
-if [ $1 == "boa100" ]
-then
-  source /go/application/venv100/bin/activate
-  neo3-boa *.py
-  deactivate
-fi
-
-if [ $1 == "boa090" ]
-then
-  source /go/application/venv090/bin/activate
-  neo3-boa *.py
-  deactivate
-fi
-
-if [ $1 == "boa083" ]
-then
-  source /go/application/venv083/bin/activate
-  neo3-boa *.py
-  deactivate
-fi
-
-if [ $1 == "boa082" ]
-then
-  source /go/application/venv082/bin/activate
-  neo3-boa *.py
-  deactivate
-fi
-
-if [ $1 == "boa081" ]
-then
-  source /go/application/venv081/bin/activate
-  neo3-boa *.py
-  deactivate
-fi
-
-if [ $1 == "boa080" ]
-then
-  source /go/application/venv080/bin/activate
-  neo3-boa *.py
-  deactivate
-fi
-
-if [ $1 == "boa071" ]
-then
-  source /go/application/venv071/bin/activate
-  neo3-boa *.py
-  deactivate
-fi
-
-if [ $1 == "boa070" ]
-then
-  source /go/application/venv083/bin/activate
-  neo3-boa *.py
-  deactivate
-fi
-
-
-
-
-
+source $1/bin/activate
+neo3-boa $2
+deactivate
@@ -0,0 +1,179 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+)
+
+// 沙箱中的编译命令因为沙箱限制失败时返回的错误码
+const sandboxViolationCode = "7"
+
+// 沙箱初始化失败时sandbox-exec的退出码
+const sandboxSetupExitCode = 125
+
+// 沙箱中默认只读挂载的系统目录，不存在的目录会被忽略
+var defaultSandboxPaths = []string{"/bin", "/sbin", "/usr", "/lib", "/lib32", "/lib64", "/libx32", "/etc"}
+
+// 只读目录中默认隐藏的文件
+var defaultSandboxHidden = []string{"/etc/shadow", "/etc/gshadow"}
+
+// 定义一次编译的沙箱配置，由服务进程生成，通过SANDBOX_SPEC环境变量传给sandbox-exec
+type sandboxSpec struct {
+	// 编译命令的工作目录，沙箱中唯一可写的目录
+	Workdir string
+	// 只读挂载的系统目录、编译器和工具链目录，沙箱的根目录中只有这些目录
+	Paths []string
+	// 只读目录中隐藏的文件或目录，例如服务的配置文件
+	Hidden []string
+	// 共享的依赖缓存，每次编译挂载为单独的overlay，编译中的写入在结束后丢弃，不会影响其它任务
+	Caches []string
+	// 允许访问网络
+	Network bool
+	// CPU时间（秒）、数据段大小（MB）、进程数以及单个输出文件大小（MB）的限制
+	CPUSeconds uint64
+	MemoryMB   uint64
+	Processes  uint64
+	OutputMB   uint64
+}
+
+// sandbox-exec通过管道写回的结果，编译命令启动之后为它的wait status，沙箱初始化失败时为错误信息。
+// 不使用编译命令的退出码和输出判断，它们都可以被上传的合约伪造
+type sandboxResult struct {
+	Status *syscall.WaitStatus `json:",omitempty"`
+	Error  string              `json:",omitempty"`
+}
+
+// 一次在沙箱中执行的命令，reader读取sandbox-exec写回的结果，没有使用沙箱时为nil
+type sandboxRun struct {
+	root   string
+	reader *os.File
+	writer *os.File
+}
+
+// 命令结束之后关闭管道并删除沙箱使用的临时目录
+func (r *sandboxRun) cleanup() {
+	if r.writer != nil {
+		r.writer.Close()
+	}
+	if r.reader != nil {
+		r.reader.Close()
+	}
+	if r.root != "" {
+		os.Remove(r.root)
+	}
+}
+
+// 在命令结束之后读取sandbox-exec写回的结果，判断是否违反了沙箱的限制
+func (r *sandboxRun) violation() error {
+	if r.reader == nil {
+		return nil
+	}
+	//关闭服务进程持有的写入端，sandbox-exec结束之后才能读到EOF
+	r.writer.Close()
+	r.writer = nil
+	data, err := ioutil.ReadAll(r.reader)
+	if err != nil {
+		return err
+	}
+	var result sandboxResult
+	if json.Unmarshal(data, &result) != nil {
+		return &sandboxError{"sandbox exited without a result"}
+	}
+	return sandboxViolation(&result)
+}
+
+// 沙箱中编译失败的原因
+type sandboxError struct {
+	msg string
+}
+
+func (e *sandboxError) Error() string {
+	return "Sandbox violation: " + e.msg
+}
+
+// SANDBOX=off时不使用沙箱，直接运行编译命令
+func sandboxEnabled() bool {
+	return os.Getenv("SANDBOX") != "off"
+}
+
+// 根据环境变量生成沙箱配置。SANDBOX_PATHS为冒号分隔的编译器和工具链目录，与系统目录、工具链安装目录和本地镜像一起只读挂载，
+// SANDBOX_CACHES为冒号分隔的共享依赖缓存目录。只读目录不能包含上传目录的上级目录，否则可以读取其它任务上传的文件
+func newSandboxSpec(workdir string) (sandboxSpec, error) {
+	dir, err := filepath.Abs(workdir)
+	if err != nil {
+		return sandboxSpec{}, err
+	}
+	spec := sandboxSpec{
+		Workdir:    dir,
+		Network:    os.Getenv("SANDBOX_NETWORK") == "on",
+		CPUSeconds: uint64(getEnvInt("SANDBOX_CPU_SECONDS", 600)),
+		MemoryMB:   uint64(getEnvInt("SANDBOX_MEMORY_MB", 4096)),
+		Processes:  uint64(getEnvInt("SANDBOX_PROCESSES", 1024)),
+		OutputMB:   uint64(getEnvInt("SANDBOX_OUTPUT_MB", 256)),
+	}
+	paths := append(append([]string{}, defaultSandboxPaths...), toolchainDir(), mirrorDir())
+	paths = append(paths, filepath.SplitList(os.Getenv("SANDBOX_PATHS"))...)
+	for _, p := range paths {
+		if p == "" {
+			continue
+		}
+		p, err = filepath.Abs(p)
+		if err != nil {
+			return sandboxSpec{}, err
+		}
+		if p == dir || strings.HasPrefix(dir, strings.TrimSuffix(p, "/")+"/") {
+			return sandboxSpec{}, errors.New("sandbox path " + p + " contains the job directory")
+		}
+		spec.Paths = append(spec.Paths, p)
+	}
+	//只读目录包含服务目录时，隐藏服务的配置文件（MongoDB的连接信息）、编译缓存和确定性检查的配置
+	hidden := append(append([]string{}, defaultSandboxHidden...), "config.yml", buildCacheDir(), determinismFile())
+	for _, h := range hidden {
+		h, err = filepath.Abs(h)
+		if err != nil {
+			return sandboxSpec{}, err
+		}
+		spec.Hidden = append(spec.Hidden, h)
+	}
+	for _, c := range filepath.SplitList(os.Getenv("SANDBOX_CACHES")) {
+		if c == "" {
+			continue
+		}
+		c, err = filepath.Abs(c)
+		if err != nil {
+			return sandboxSpec{}, err
+		}
+		spec.Caches = append(spec.Caches, c)
+	}
+	return spec, nil
+}
+
+// 根据sandbox-exec写回的结果判断是否违反了沙箱的限制，没有违反时返回nil。
+// 只有超过CPU时间、进程被强制结束以及超过输出文件大小限制的信号视为违反限制，
+// 超过内存或进程数限制时编译命令只会遇到分配失败，按普通的编译错误处理。
+// 只能看到编译命令本身的wait status，编译脚本（例如goExec.sh）中的子进程被信号结束时脚本只返回退出码，也按普通的编译错误处理
+func sandboxViolation(result *sandboxResult) error {
+	if result == nil {
+		return nil
+	}
+	if result.Status == nil {
+		return &sandboxError{result.Error}
+	}
+	if !result.Status.Signaled() {
+		return nil
+	}
+	switch result.Status.Signal() {
+	case syscall.SIGXCPU:
+		return &sandboxError{"CPU time limit exceeded"}
+	case syscall.SIGKILL:
+		return &sandboxError{"compiler was killed, CPU time or memory limit exceeded"}
+	case syscall.SIGXFSZ:
+		return &sandboxError{"output file size limit exceeded"}
+	}
+	return nil
+}
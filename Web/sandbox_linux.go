@@ -0,0 +1,442 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"syscall"
+)
+
+// syscall中没有定义RLIMIT_NPROC
+const rlimitNproc = 0x6
+
+// sandbox-exec写回结果的文件描述符，对应cmd.ExtraFiles[0]
+const sandboxResultFd = 3
+
+// 把编译命令改为通过sandbox-exec在新的user、mount、pid、ipc、uts和network namespace中执行，
+// 返回的sandboxRun在命令结束之后读取结果并清理沙箱使用的临时目录
+func sandboxCommand(cmd *exec.Cmd) (*sandboxRun, error) {
+	if !sandboxEnabled() {
+		return &sandboxRun{}, nil
+	}
+	exe, err := os.Executable()
+	if err != nil {
+		return nil, err
+	}
+	workdir := cmd.Dir
+	if workdir == "" {
+		workdir = "."
+	}
+	spec, err := newSandboxSpec(workdir)
+	if err != nil {
+		return nil, err
+	}
+	data, err := json.Marshal(spec)
+	if err != nil {
+		return nil, err
+	}
+	//新的根目录的挂载点，在宿主机上始终是空目录
+	root, err := ioutil.TempDir("", "sandbox-")
+	if err != nil {
+		return nil, err
+	}
+	run := &sandboxRun{root: root}
+	run.reader, run.writer, err = os.Pipe()
+	if err != nil {
+		run.cleanup()
+		return nil, err
+	}
+	if cmd.Env == nil {
+		cmd.Env = os.Environ()
+	}
+	cmd.Env = append(cmd.Env, "SANDBOX_SPEC="+string(data), "SANDBOX_ROOT="+root)
+	cmd.Args = append([]string{exe, "sandbox-exec", cmd.Path}, cmd.Args[1:]...)
+	cmd.Path = exe
+	cmd.ExtraFiles = []*os.File{run.writer}
+	flags := syscall.CLONE_NEWUSER | syscall.CLONE_NEWNS | syscall.CLONE_NEWPID | syscall.CLONE_NEWIPC | syscall.CLONE_NEWUTS
+	if !spec.Network {
+		flags |= syscall.CLONE_NEWNET
+	}
+	//sandbox-exec在namespace中是root，只有这样才能挂载目录，对应宿主机上的服务用户
+	cmd.SysProcAttr = &syscall.SysProcAttr{
+		Cloneflags:                 uintptr(flags),
+		UidMappings:                []syscall.SysProcIDMap{{ContainerID: 0, HostID: os.Getuid(), Size: 1}},
+		GidMappings:                []syscall.SysProcIDMap{{ContainerID: 0, HostID: os.Getgid(), Size: 1}},
+		GidMappingsEnableSetgroups: false,
+		Pdeathsig:                  syscall.SIGKILL,
+	}
+	return run, nil
+}
+
+// 检查当前环境能否创建沙箱
+func checkSandbox() error {
+	if !sandboxEnabled() {
+		return nil
+	}
+	cmd := exec.Command("/bin/true")
+	run, err := sandboxCommand(cmd)
+	if err != nil {
+		return err
+	}
+	defer run.cleanup()
+	out, err := cmd.CombinedOutput()
+	if violation := run.violation(); violation != nil {
+		return violation
+	}
+	if err != nil {
+		return fmt.Errorf("%v: %s", err, strings.TrimSpace(string(out)))
+	}
+	return nil
+}
+
+// sandbox-exec：在namespace中用只读的系统目录、编译器目录和可写的工作目录组成新的根目录，设置资源限制之后执行编译命令。
+// sandbox-exec是pid namespace中的1号进程，namespace中的1号进程会忽略SIGXCPU等信号，所以编译命令作为子进程运行，
+// 编译命令的wait status通过管道写回服务进程，sandbox-exec退出时namespace中遗留的进程（如gradle daemon）都会被结束
+func sandboxExec(args []string) int {
+	//编译命令不能继承写回结果的管道
+	syscall.CloseOnExec(sandboxResultFd)
+	if len(args) == 0 {
+		return sandboxSetupFailed(errors.New("no command"))
+	}
+	var spec sandboxSpec
+	err := json.Unmarshal([]byte(os.Getenv("SANDBOX_SPEC")), &spec)
+	if err == nil {
+		err = setupSandbox(spec, os.Getenv("SANDBOX_ROOT"))
+	}
+	if err != nil {
+		return sandboxSetupFailed(err)
+	}
+	env := []string{}
+	for _, e := range os.Environ() {
+		if !strings.HasPrefix(e, "SANDBOX_SPEC=") && !strings.HasPrefix(e, "SANDBOX_ROOT=") {
+			env = append(env, e)
+		}
+	}
+	cmd := exec.Command(args[0], args[1:]...)
+	cmd.Env = env
+	cmd.Stdin = os.Stdin
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	err = cmd.Start()
+	if err != nil {
+		return sandboxSetupFailed(err)
+	}
+	//回收namespace中所有结束的进程，直到编译命令结束
+	for {
+		var status syscall.WaitStatus
+		pid, err := syscall.Wait4(-1, &status, 0, nil)
+		if err == syscall.EINTR {
+			continue
+		}
+		if err != nil {
+			return sandboxSetupFailed(err)
+		}
+		if pid != cmd.Process.Pid {
+			continue
+		}
+		writeSandboxResult(sandboxResult{Status: &status})
+		if status.Signaled() {
+			return 128 + int(status.Signal())
+		}
+		return status.ExitStatus()
+	}
+}
+
+func sandboxSetupFailed(err error) int {
+	fmt.Fprintln(os.Stderr, "sandbox: "+err.Error())
+	writeSandboxResult(sandboxResult{Error: err.Error()})
+	return sandboxSetupExitCode
+}
+
+func writeSandboxResult(result sandboxResult) {
+	data, _ := json.Marshal(result)
+	f := os.NewFile(sandboxResultFd, "sandbox-result")
+	f.Write(data)
+	f.Close()
+}
+
+func setupSandbox(spec sandboxSpec, root string) error {
+	if root == "" || spec.Workdir == "" {
+		return errors.New("invalid sandbox spec")
+	}
+	//namespace中的挂载不影响宿主机
+	err := syscall.Mount("", "/", "", syscall.MS_REC|syscall.MS_PRIVATE, "")
+	if err != nil {
+		return fmt.Errorf("make mounts private: %v", err)
+	}
+	//新的根目录是空的tmpfs，其中只有允许访问的目录，服务的配置文件、其它任务的上传目录以及编译缓存都不存在
+	err = syscall.Mount("tmpfs", root, "tmpfs", syscall.MS_NOSUID|syscall.MS_NODEV, "mode=0755")
+	if err != nil {
+		return fmt.Errorf("mount root: %v", err)
+	}
+	paths := append([]string{}, spec.Paths...)
+	sort.Strings(paths)
+	for _, p := range paths {
+		err = bindReadOnly(p, filepath.Join(root, p))
+		if err != nil {
+			return err
+		}
+	}
+	for _, h := range spec.Hidden {
+		err = hidePath(filepath.Join(root, h))
+		if err != nil {
+			return err
+		}
+	}
+	err = bindMount("/dev", filepath.Join(root, "dev"))
+	if err != nil {
+		return err
+	}
+	//私有的/tmp，以及唯一可写的工作目录
+	err = os.MkdirAll(filepath.Join(root, "tmp"), 0755)
+	if err == nil {
+		err = syscall.Mount("tmpfs", filepath.Join(root, "tmp"), "tmpfs", syscall.MS_NOSUID|syscall.MS_NODEV, "mode=1777")
+	}
+	if err != nil {
+		return fmt.Errorf("mount /tmp: %v", err)
+	}
+	err = bindMount(spec.Workdir, filepath.Join(root, spec.Workdir))
+	if err != nil {
+		return err
+	}
+	for i, dir := range spec.Caches {
+		if _, err := os.Stat(dir); err != nil {
+			continue
+		}
+		target := filepath.Join(root, dir)
+		err = os.MkdirAll(target, 0755)
+		if err == nil {
+			err = mountCacheOverlay(dir, target, filepath.Join(root, "tmp", ".sandbox-cache", strconv.Itoa(i)))
+		}
+		if err != nil {
+			//不支持overlay时缓存只读，需要写入缓存的编译会失败，但不会污染其它任务使用的缓存
+			fmt.Fprintln(os.Stderr, "sandbox warning: cache "+dir+" is read-only: "+err.Error())
+			err = bindReadOnly(dir, target)
+			if err != nil {
+				return err
+			}
+		}
+	}
+	//新的pid namespace使用自己的/proc，在容器中不允许挂载时没有/proc
+	err = os.MkdirAll(filepath.Join(root, "proc"), 0755)
+	if err == nil {
+		syscall.Mount("proc", filepath.Join(root, "proc"), "proc", syscall.MS_NOSUID|syscall.MS_NODEV|syscall.MS_NOEXEC, "")
+	}
+	//所有挂载点创建之后，根目录本身也是只读的
+	err = syscall.Mount("", root, "", syscall.MS_BIND|syscall.MS_REMOUNT|syscall.MS_RDONLY|syscall.MS_NOSUID|syscall.MS_NODEV, "")
+	if err != nil {
+		return fmt.Errorf("remount root read-only: %v", err)
+	}
+	err = os.Chdir(root)
+	if err == nil {
+		err = syscall.PivotRoot(".", ".")
+	}
+	if err == nil {
+		err = syscall.Unmount(".", syscall.MNT_DETACH)
+	}
+	if err != nil {
+		return fmt.Errorf("pivot root: %v", err)
+	}
+	err = os.Chdir(spec.Workdir)
+	if err != nil {
+		return err
+	}
+	limits := []struct {
+		resource int
+		value    uint64
+	}{
+		{syscall.RLIMIT_CPU, spec.CPUSeconds},
+		{syscall.RLIMIT_DATA, spec.MemoryMB << 20},
+		{rlimitNproc, spec.Processes},
+		{syscall.RLIMIT_FSIZE, spec.OutputMB << 20},
+	}
+	for _, l := range limits {
+		if l.value == 0 {
+			continue
+		}
+		//超过软限制时先收到SIGXCPU或SIGXFSZ，CPU时间超过硬限制时被强制结束
+		max := l.value
+		if l.resource == syscall.RLIMIT_CPU {
+			max = l.value + 5
+		}
+		err = syscall.Setrlimit(l.resource, &syscall.Rlimit{Cur: l.value, Max: max})
+		if err != nil {
+			return fmt.Errorf("set rlimit %d: %v", l.resource, err)
+		}
+	}
+	return nil
+}
+
+// 在新的根目录中创建与源路径类型相同的挂载点，源路径是符号链接时复制符号链接，返回false表示不需要挂载
+func createMountpoint(source string, target string) (bool, error) {
+	info, err := os.Lstat(source)
+	if os.IsNotExist(err) {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	err = os.MkdirAll(filepath.Dir(target), 0755)
+	if err != nil {
+		return false, err
+	}
+	if info.Mode()&os.ModeSymlink != 0 {
+		link, err := os.Readlink(source)
+		if err != nil {
+			return false, err
+		}
+		if _, err := os.Lstat(target); err == nil {
+			return false, nil
+		}
+		return false, os.Symlink(link, target)
+	}
+	if info.IsDir() {
+		return true, os.MkdirAll(target, 0755)
+	}
+	if _, err := os.Lstat(target); err == nil {
+		return true, nil
+	}
+	f, err := os.OpenFile(target, os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		return false, err
+	}
+	return true, f.Close()
+}
+
+func bindMount(source string, target string) error {
+	ok, err := createMountpoint(source, target)
+	if err == nil && ok {
+		err = syscall.Mount(source, target, "", syscall.MS_BIND|syscall.MS_REC, "")
+	}
+	if err != nil {
+		return fmt.Errorf("bind %s: %v", source, err)
+	}
+	return nil
+}
+
+// 只读挂载source以及其中所有的挂载点，不存在的路径会被忽略
+func bindReadOnly(source string, target string) error {
+	err := bindMount(source, target)
+	if err != nil {
+		return err
+	}
+	if _, err := os.Lstat(target); err != nil {
+		return nil
+	}
+	return remountReadOnly(target)
+}
+
+// 用空的只读tmpfs或/dev/null覆盖只读目录中的文件或目录，path不存在时忽略
+func hidePath(path string) error {
+	info, err := os.Lstat(path)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if info.IsDir() {
+		err = syscall.Mount("tmpfs", path, "tmpfs", syscall.MS_RDONLY|syscall.MS_NOSUID|syscall.MS_NODEV|syscall.MS_NOEXEC, "")
+	} else {
+		err = syscall.Mount("/dev/null", path, "", syscall.MS_BIND, "")
+	}
+	if err != nil {
+		return fmt.Errorf("hide %s: %v", path, err)
+	}
+	return nil
+}
+
+// 在共享缓存上挂载overlay，写入保存在沙箱私有的/tmp中，编译结束后随namespace一起丢弃
+func mountCacheOverlay(lower string, target string, scratch string) error {
+	upper := filepath.Join(scratch, "upper")
+	work := filepath.Join(scratch, "work")
+	for _, d := range []string{upper, work} {
+		err := os.MkdirAll(d, 0755)
+		if err != nil {
+			return err
+		}
+	}
+	options := "lowerdir=" + lower + ",upperdir=" + upper + ",workdir=" + work
+	//user namespace中需要userxattr（linux 5.11+），较早的内核不支持该选项
+	err := syscall.Mount("overlay", target, "overlay", 0, options+",userxattr")
+	if err != nil {
+		err = syscall.Mount("overlay", target, "overlay", 0, options)
+	}
+	return err
+}
+
+// 把root下的所有挂载点重新挂载为只读，需要保留原来的nosuid、nodev等标记
+func remountReadOnly(root string) error {
+	f, err := os.Open("/proc/self/mountinfo")
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	mounts := []string{}
+	s := bufio.NewScanner(f)
+	for s.Scan() {
+		fields := strings.Fields(s.Text())
+		if len(fields) < 5 {
+			continue
+		}
+		p := unescapeMountPath(fields[4])
+		if p != root && !strings.HasPrefix(p, root+"/") {
+			continue
+		}
+		mounts = append(mounts, p)
+	}
+	sort.Strings(mounts)
+	flags := []struct{ st, ms int64 }{
+		{0x2, syscall.MS_NOSUID},
+		{0x4, syscall.MS_NODEV},
+		{0x8, syscall.MS_NOEXEC},
+		{0x400, syscall.MS_NOATIME},
+		{0x800, syscall.MS_NODIRATIME},
+		{0x1000, syscall.MS_RELATIME},
+	}
+	for _, p := range mounts {
+		var st syscall.Statfs_t
+		err = syscall.Statfs(p, &st)
+		if err != nil {
+			return fmt.Errorf("statfs %s: %v", p, err)
+		}
+		ms := int64(syscall.MS_BIND | syscall.MS_REMOUNT | syscall.MS_RDONLY)
+		for _, fl := range flags {
+			if int64(st.Flags)&fl.st != 0 {
+				ms |= fl.ms
+			}
+		}
+		err = syscall.Mount("", p, "", uintptr(ms), "")
+		if err != nil {
+			return fmt.Errorf("remount %s read-only: %v", p, err)
+		}
+	}
+	return nil
+}
+
+// mountinfo中的空格等字符转义为\ooo
+func unescapeMountPath(p string) string {
+	if !strings.Contains(p, "\\") {
+		return p
+	}
+	var b strings.Builder
+	for i := 0; i < len(p); i++ {
+		if p[i] == '\\' && i+3 < len(p) {
+			if v, err := strconv.ParseUint(p[i+1:i+4], 8, 8); err == nil {
+				b.WriteByte(byte(v))
+				i += 3
+				continue
+			}
+		}
+		b.WriteByte(p[i])
+	}
+	return b.String()
+}
@@ -0,0 +1,29 @@
+//go:build !linux
+// +build !linux
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+)
+
+// 只有linux支持沙箱，其它系统需要设置SANDBOX=off
+func sandboxCommand(cmd *exec.Cmd) (*sandboxRun, error) {
+	if !sandboxEnabled() {
+		return &sandboxRun{}, nil
+	}
+	return nil, errors.New("sandbox is only supported on linux, please set SANDBOX=off")
+}
+
+func checkSandbox() error {
+	_, err := sandboxCommand(nil)
+	return err
+}
+
+func sandboxExec(args []string) int {
+	fmt.Fprintln(os.Stderr, "sandbox: only supported on linux")
+	return sandboxSetupExitCode
+}
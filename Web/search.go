@@ -0,0 +1,211 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// 所有搜索共享的编译任务数量，避免一次搜索占满整台机器
+var searchWorkers = make(chan struct{}, getEnvInt("SEARCH_WORKERS", 4))
+
+// 单次搜索最多同时运行的编译任务数量
+var searchParallel = getEnvInt("SEARCH_PARALLEL", 2)
+
+// 定义搜索过程中尝试过的一种编译器版本和选项组合
+type searchAttempt struct {
+	Version        string
+	CompileCommand string
+	Result         string
+}
+
+// 定义搜索结果，Match为第一个匹配的编译器版本，没有匹配时为空
+type searchReport struct {
+	Match          string
+	CompileCommand string
+	Tried          []searchAttempt
+}
+
+// 返回编译器注册表中与当前编译器同名的其它版本和选项组合
+func searchCandidates(m map[string]string) []searchAttempt {
+	candidates := []searchAttempt{}
+	current, err := compilers.lookup(getVersion(m))
+	if err != nil {
+		return candidates
+	}
+	for _, c := range compilers.all() {
+		if c.Identity().Name != current.Identity().Name || compilers.unavailableReason(c.ID()) != "" {
+			continue
+		}
+		options := c.Options()
+		if len(options) == 0 {
+			options = []string{""}
+		}
+		for _, o := range options {
+			if c.ID() == current.ID() && o == strings.TrimSpace(getCompileCommand(m)) {
+				continue
+			}
+			candidates = append(candidates, searchAttempt{Version: c.ID(), CompileCommand: o})
+		}
+	}
+	return candidates
+}
+
+// 用其它版本和选项重新编译同一份源码，每次编译使用单独的目录，返回搜索结果和匹配的编译目录，
+// 找到匹配的结果或者ctx被取消时结束其它正在运行的编译
+func searchCompilers(ctx context.Context, pathFile string, folderName string, m map[string]string, state contractState) (searchReport, string) {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	candidates := searchCandidates(m)
+	report := searchReport{Tried: candidates}
+	dirs := make([]string, len(candidates))
+	var mu sync.Mutex
+	found := false
+	var wg sync.WaitGroup
+	parallel := make(chan struct{}, searchParallel)
+	for i := range candidates {
+		mu.Lock()
+		stop := found
+		mu.Unlock()
+		if stop || ctx.Err() != nil {
+			candidates[i].Result = "skipped"
+			continue
+		}
+		//等待空闲的编译槽时也要响应取消，否则匹配或超时之后仍会阻塞到其它编译结束
+		select {
+		case parallel <- struct{}{}:
+		case <-ctx.Done():
+			candidates[i].Result = "skipped"
+			continue
+		}
+		select {
+		case searchWorkers <- struct{}{}:
+		case <-ctx.Done():
+			<-parallel
+			candidates[i].Result = "skipped"
+			continue
+		}
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			defer func() {
+				<-searchWorkers
+				<-parallel
+			}()
+			dir := pathFile + "_search_" + strconv.Itoa(i)
+			dirs[i] = dir
+			err := copyWorkspace(pathFile, dir)
+			if err != nil {
+				candidates[i].Result = "copy error"
+				return
+			}
+			attempt := copyParams(m)
+			attempt["Version"] = candidates[i].Version
+			attempt["CompileCommand"] = candidates[i].CompileCommand
+			fmt.Println("Search: " + candidates[i].Version + " " + candidates[i].CompileCommand)
+			result := compileContract(ctx, dir, folderName+"_search_"+strconv.Itoa(i), attempt)
+			if result == compileTimeoutCode {
+				mu.Lock()
+				if found {
+					candidates[i].Result = "skipped"
+				} else {
+					candidates[i].Result = "timeout"
+				}
+				mu.Unlock()
+				return
+			}
+			if isCompileError(result) {
+				candidates[i].Result = "compile error"
+				return
+			}
+			if result != state.Script {
+				candidates[i].Result = "mismatch"
+				return
+			}
+			if getStrict(attempt) {
+				nefResult := verifyNefFields(dir, attempt, state.Nef)
+				if len(nefResult.Mismatched) != 0 || nefResult.Error != "" {
+					candidates[i].Result = "mismatch"
+					return
+				}
+			}
+			candidates[i].Result = "match"
+			mu.Lock()
+			found = true
+			mu.Unlock()
+			cancel()
+		}(i)
+	}
+	wg.Wait()
+	matchDir := ""
+	for i, c := range candidates {
+		if c.Result == "match" && matchDir == "" {
+			report.Match = c.Version
+			report.CompileCommand = c.CompileCommand
+			matchDir = dirs[i]
+			continue
+		}
+		if dirs[i] != "" {
+			os.RemoveAll(dirs[i])
+		}
+	}
+	fmt.Println("Search result:", report.Match, report.CompileCommand)
+	return report, matchDir
+}
+
+// 复制用户上传的源文件到新的编译目录，保留目录结构，不复制编译生成的目录和文件
+func copyWorkspace(src string, dst string) error {
+	err := os.MkdirAll(dst, 0777)
+	if err != nil {
+		return err
+	}
+	files, err := walkSources(src)
+	if err != nil {
+		return err
+	}
+	for _, f := range files {
+		if isBuildOutput(f) {
+			continue
+		}
+		data, err := ioutil.ReadFile(src + "/" + f)
+		if err != nil {
+			return err
+		}
+		err = os.MkdirAll(path.Dir(dst+"/"+f), 0777)
+		if err != nil {
+			return err
+		}
+		err = ioutil.WriteFile(dst+"/"+f, data, 0666)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// 判断文件是否为编译生成的.nef、.manifest.json或调试信息
+func isBuildOutput(f string) bool {
+	ext := path.Ext(f)
+	return ext == ".nef" || ext == ".nefdbgnfo" || strings.HasSuffix(f, ".manifest.json") || strings.HasSuffix(f, ".debug.json")
+}
+
+func copyParams(m map[string]string) map[string]string {
+	c := make(map[string]string, len(m))
+	for k, v := range m {
+		c[k] = v
+	}
+	return c
+}
+
+func getEnvInt(key string, def int) int {
+	v, err := strconv.Atoi(os.Getenv(key))
+	if err != nil || v <= 0 {
+		return def
+	}
+	return v
+}
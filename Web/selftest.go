@@ -0,0 +1,384 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/prometheus/client_golang/prometheus"
+	"gopkg.in/yaml.v3"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+// 自检结果的状态
+const (
+	selfTestPassed   = "passed"
+	selfTestFailed   = "failed"
+	selfTestMismatch = "mismatch"
+	selfTestUntested = "untested"
+)
+
+// 测试合约中替换成编译器版本的占位符
+const fixtureVersionPlaceholder = "@COMPILER_VERSION@"
+
+// 定义一种语言的测试合约，Dir为相对于fixtures目录的路径，Form为额外的上传表单字段
+type selfTestFixture struct {
+	Language string            `yaml:"language"`
+	Dir      string            `yaml:"dir"`
+	Form     map[string]string `yaml:"form"`
+}
+
+// 定义fixtures目录中的selftest.yml以及记录已知正确结果的expected.yml，
+// Expected的key为"编译器ID|编译选项"，value为.nef文件的sha256
+type selfTestConfig struct {
+	Fixtures []selfTestFixture `yaml:"fixtures"`
+	Expected map[string]string `yaml:"-"`
+}
+
+// 定义一个编译器和编译选项组合的自检结果
+type selfTestResult struct {
+	Compiler       string
+	CompileCommand string `json:",omitempty"`
+	Status         string
+	Msg            string `json:",omitempty"`
+	NefSha256      string `json:",omitempty"`
+	Seconds        float64
+}
+
+// 保存最近一次自检的结果，供/health接口使用
+var selfTests = struct {
+	sync.RWMutex
+	running bool
+	results []selfTestResult
+}{}
+
+var (
+	selfTestStatus = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "compiler_selftest_passed",
+		Help: "Whether the last self-test of a compiler and compile command matched the expected nef hash (1) or not (0).",
+	}, []string{"compiler", "command"})
+	selfTestDuration = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "compiler_selftest_duration_seconds",
+		Help: "Duration of the last self-test of a compiler and compile command.",
+	}, []string{"compiler", "command"})
+	compilerAvailable = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "compiler_available",
+		Help: "Whether a registered compiler accepts submissions (1) or was marked unavailable by the self-test (0).",
+	}, []string{"compiler"})
+)
+
+func init() {
+	prometheus.MustRegister(selfTestStatus, selfTestDuration, compilerAvailable)
+}
+
+// 测试合约所在的目录，可以通过SELFTEST_FIXTURES环境变量指定
+func fixturesDir() string {
+	if d := os.Getenv("SELFTEST_FIXTURES"); d != "" {
+		return d
+	}
+	return "fixtures"
+}
+
+func loadSelfTestConfig(dir string) (selfTestConfig, error) {
+	cfg := selfTestConfig{}
+	data, err := ioutil.ReadFile(filepath.Join(dir, "selftest.yml"))
+	if err != nil {
+		return cfg, err
+	}
+	err = yaml.Unmarshal(data, &cfg)
+	if err != nil {
+		return cfg, err
+	}
+	cfg.Expected = map[string]string{}
+	data, err = ioutil.ReadFile(filepath.Join(dir, "expected.yml"))
+	if os.IsNotExist(err) {
+		return cfg, nil
+	}
+	if err != nil {
+		return cfg, err
+	}
+	err = yaml.Unmarshal(data, &cfg.Expected)
+	return cfg, err
+}
+
+// 把已知正确的编译结果写入expected.yml
+func (cfg selfTestConfig) saveExpected(dir string) error {
+	data, err := yaml.Marshal(cfg.Expected)
+	if err != nil {
+		return err
+	}
+	data = append([]byte("# 由 ./main selftest record 生成，key为\"编译器ID|编译选项\"，value为.nef文件的sha256\n"), data...)
+	return ioutil.WriteFile(filepath.Join(dir, "expected.yml"), data, 0666)
+}
+
+// 返回语言对应的测试合约，没有时返回nil
+func (cfg selfTestConfig) fixture(language string) *selfTestFixture {
+	for i := range cfg.Fixtures {
+		if cfg.Fixtures[i].Language == language {
+			return &cfg.Fixtures[i]
+		}
+	}
+	return nil
+}
+
+// SELFTEST_REQUIRE_EXPECTED=on时没有记录hash的组合也视为失败，发布的镜像中记录了expected.yml之后应该开启
+func selfTestRequireExpected() bool {
+	return os.Getenv("SELFTEST_REQUIRE_EXPECTED") == "on"
+}
+
+// 用测试合约依次编译每个编译器的每种编译选项，与记录的.nef hash比较，
+// 有任何组合失败的编译器被标记为不可用，不再接受用户的编译请求。
+// 没有记录hash的组合为untested，默认不影响可用状态，但/health返回degraded
+func runSelfTest(registry *compilerRegistry, cfg selfTestConfig, dir string) []selfTestResult {
+	selfTests.Lock()
+	selfTests.running = true
+	selfTests.Unlock()
+	results := []selfTestResult{}
+	for _, c := range registry.all() {
+		options := c.Options()
+		if len(options) == 0 {
+			options = []string{""}
+		}
+		reason := ""
+		for _, o := range options {
+			r := selfTestCompiler(c, o, cfg, dir)
+			fmt.Println("Self-test: " + c.ID() + " " + o + ": " + r.Status + " " + r.Msg)
+			passed := 0.0
+			if r.Status == selfTestPassed {
+				passed = 1
+			} else if (r.Status != selfTestUntested || selfTestRequireExpected()) && reason == "" {
+				reason = "self-test " + r.Status
+				if o != "" {
+					reason += " with " + o
+				}
+				reason += ": " + r.Msg
+			}
+			selfTestStatus.WithLabelValues(c.ID(), o).Set(passed)
+			selfTestDuration.WithLabelValues(c.ID(), o).Set(r.Seconds)
+			results = append(results, r)
+		}
+		registry.setUnavailable(c.ID(), reason)
+		if reason == "" {
+			compilerAvailable.WithLabelValues(c.ID()).Set(1)
+		} else {
+			compilerAvailable.WithLabelValues(c.ID()).Set(0)
+		}
+	}
+	selfTests.Lock()
+	selfTests.running = false
+	selfTests.results = results
+	selfTests.Unlock()
+	return results
+}
+
+// 在单独的目录中编译测试合约，结果不受注册表中可用状态的影响
+func selfTestCompiler(c Compiler, option string, cfg selfTestConfig, dir string) (r selfTestResult) {
+	r = selfTestResult{Compiler: c.ID(), CompileCommand: option}
+	fixture := cfg.fixture(c.Language())
+	if fixture == nil {
+		r.Status = selfTestUntested
+		r.Msg = "no fixture for " + c.Language()
+		return r
+	}
+	start := time.Now()
+	defer func() {
+		r.Seconds = time.Since(start).Seconds()
+	}()
+	pathFile, err := ioutil.TempDir(".", "selftest-")
+	if err != nil {
+		r.Status, r.Msg = selfTestFailed, err.Error()
+		return r
+	}
+	defer os.RemoveAll(pathFile)
+	err = copyFixture(filepath.Join(dir, fixture.Dir), pathFile, c.Identity().Version)
+	if err != nil {
+		r.Status, r.Msg = selfTestFailed, err.Error()
+		return r
+	}
+	m := map[string]string{"CompileCommand": option}
+	for k, v := range fixture.Form {
+		m[k] = v
+	}
+	err = c.Install(context.Background())
+	if err == nil {
+		r.NefSha256, _, err = buildHashes(c, pathFile, m)
+	}
+	if err != nil {
+		r.Status, r.Msg = selfTestFailed, err.Error()
+		return r
+	}
+	//没有记录已知正确的hash时只能确认可以编译，不视为通过
+	expected := cfg.Expected[c.ID()+"|"+option]
+	if expected == "" {
+		r.Status = selfTestUntested
+		r.Msg = "no expected nef hash recorded"
+		return r
+	}
+	if expected != r.NefSha256 {
+		r.Status = selfTestMismatch
+		r.Msg = "nef hash is " + r.NefSha256 + ", expected " + expected
+		return r
+	}
+	r.Status = selfTestPassed
+	return r
+}
+
+// 复制测试合约，替换文件中的编译器版本
+func copyFixture(src string, dst string, version string) error {
+	files, err := walkSources(src)
+	if err != nil {
+		return err
+	}
+	if len(files) == 0 {
+		return errors.New("fixture " + src + " is empty")
+	}
+	for _, f := range files {
+		data, err := ioutil.ReadFile(filepath.Join(src, f))
+		if err != nil {
+			return err
+		}
+		data = []byte(strings.ReplaceAll(string(data), fixtureVersionPlaceholder, version))
+		out, err := createUploadFile(dst, f)
+		if err != nil {
+			return err
+		}
+		_, err = out.Write(data)
+		out.Close()
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// 返回编译输出的最后几行，用于错误信息
+func lastLines(s string, n int) string {
+	lines := strings.Split(strings.TrimSpace(s), "\n")
+	if len(lines) > n {
+		lines = lines[len(lines)-n:]
+	}
+	return strings.Join(lines, "\n")
+}
+
+// 启动时在后台运行自检，SELFTEST=off时跳过。自检逐个编译所有组合，需要较长时间，
+// 默认在自检完成之前编译器保持可用；SELFTEST_GATE=on时编译器在自己的自检通过之前不接受编译请求
+func startSelfTest() {
+	if os.Getenv("SELFTEST") == "off" {
+		return
+	}
+	cfg, err := loadSelfTestConfig(fixturesDir())
+	if err != nil {
+		fmt.Println("Self-test: load fixtures error", err)
+		return
+	}
+	if len(cfg.Expected) == 0 {
+		fmt.Println("Self-test WARNING: " + filepath.Join(fixturesDir(), "expected.yml") + " has no recorded nef hashes, compilers can't be checked against known results, run ./main selftest record in the release image")
+	}
+	if os.Getenv("SELFTEST_GATE") == "on" {
+		for _, c := range compilers.all() {
+			compilers.setUnavailable(c.ID(), "self-test pending")
+		}
+	}
+	go runSelfTest(compilers, cfg, fixturesDir())
+}
+
+// 返回自检结果以及编译结果不一致的编译器，有不可用的编译器或者没有记录hash的组合时为degraded，
+// 所有编译器都不可用时返回503
+func healthHandler(w http.ResponseWriter, r *http.Request) {
+	selfTests.RLock()
+	results := selfTests.results
+	running := selfTests.running
+	selfTests.RUnlock()
+	unavailable := map[string]string{}
+	flaky := map[string]string{}
+	untested := map[string]string{}
+	for _, r := range results {
+		if r.Status == selfTestUntested {
+			untested[r.Compiler] = r.Msg
+		}
+	}
+	for _, c := range compilers.all() {
+		if reason := compilers.unavailableReason(c.ID()); reason != "" {
+			unavailable[c.ID()] = reason
+		}
+		if reason := compilers.flakyReason(c.ID()); reason != "" {
+			flaky[c.ID()] = reason
+		}
+	}
+	status := "ok"
+	if len(unavailable) > 0 || len(untested) > 0 {
+		status = "degraded"
+	}
+	code := http.StatusOK
+	if len(compilers.all()) > 0 && len(unavailable) == len(compilers.all()) {
+		status = "unavailable"
+		code = http.StatusServiceUnavailable
+	}
+	msg, _ := json.Marshal(struct {
+		Status      string
+		Running     bool
+		Unavailable map[string]string
+		Flaky       map[string]string
+		Untested    map[string]string
+		Results     []selfTestResult
+	}{status, running, unavailable, flaky, untested, results})
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	w.Write(msg)
+}
+
+// 手动运行自检的命令：
+//
+//	selftest run     编译所有测试合约并与记录的hash比较，有失败时返回1
+//	selftest record  编译所有测试合约并把.nef的hash记录到expected.yml
+func selfTestCommand(args []string) int {
+	registry, err := loadCompilerRegistry(compilersConfigFile())
+	if err != nil {
+		fmt.Println(err)
+		return 1
+	}
+	mirrors, err = loadMirrors(mirrorDir())
+	if err != nil {
+		fmt.Println(err)
+		return 1
+	}
+	cfg, err := loadSelfTestConfig(fixturesDir())
+	if err != nil {
+		fmt.Println(err)
+		return 1
+	}
+	if len(args) != 1 || (args[0] != "run" && args[0] != "record") {
+		fmt.Println("usage: selftest run | selftest record")
+		return 2
+	}
+	if args[0] == "record" {
+		cfg.Expected = map[string]string{}
+	}
+	failed := 0
+	for _, r := range runSelfTest(registry, cfg, fixturesDir()) {
+		if r.Status == selfTestFailed || r.Status == selfTestMismatch || (args[0] == "run" && r.Status == selfTestUntested && selfTestRequireExpected()) {
+			failed++
+		}
+		if args[0] == "record" && r.NefSha256 != "" {
+			cfg.Expected[r.Compiler+"|"+r.CompileCommand] = r.NefSha256
+		}
+	}
+	if args[0] == "record" {
+		err = cfg.saveExpected(fixturesDir())
+		if err != nil {
+			fmt.Println(err)
+			return 1
+		}
+	}
+	if failed > 0 {
+		fmt.Println(failed, "self-tests failed")
+		return 1
+	}
+	return 0
+}
@@ -0,0 +1,133 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/nspcc-dev/neo-go/pkg/io"
+	"github.com/nspcc-dev/neo-go/pkg/smartcontract/manifest"
+	"github.com/nspcc-dev/neo-go/pkg/smartcontract/nef"
+	"github.com/tidwall/gjson"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// 通过相同字节码匹配到已验证合约的记录状态
+const statusSimilar = "similar"
+
+// 计算nef中script和tokens的sha256，参数为getcontractstate返回的nef json，
+// 不包含compiler、source等元数据，相同模板部署的合约得到相同的结果
+func scriptHash(nefJSON string) string {
+	var f nef.File
+	err := json.Unmarshal([]byte(nefJSON), &f)
+	if err != nil {
+		return ""
+	}
+	w := io.NewBufBinWriter()
+	w.WriteVarBytes(f.Script)
+	w.WriteArray(f.Tokens)
+	if w.Err != nil {
+		return ""
+	}
+	h := sha256.Sum256(w.Bytes())
+	return hex.EncodeToString(h[:])
+}
+
+// 在VerifyContractModel表的scripthash字段上建立索引
+func ensureScriptHashIndex(ctx context.Context, db *mongo.Database) error {
+	_, err := db.Collection("VerifyContractModel").Indexes().CreateOne(ctx, mongo.IndexModel{Keys: bson.M{"scripthash": 1}})
+	return err
+}
+
+// 合约部署或更新之后，如果它的script和tokens与某个已验证合约一致，
+// 插入一条similar记录，指向原合约的验证记录和源代码，不需要重新编译
+func similarMatch(ctx context.Context, db *mongo.Database, contract string) error {
+	body, err := rpcCall("getcontractstate", []interface{}{contract})
+	if err != nil {
+		return err
+	}
+	if gjson.GetBytes(body, "error").Exists() {
+		return nil
+	}
+	hash := scriptHash(gjson.GetBytes(body, "result.nef").Raw)
+	if hash == "" {
+		return nil
+	}
+	id := int(gjson.GetBytes(body, "result.id").Int())
+	counter := int(gjson.GetBytes(body, "result.updatecounter").Int())
+	collection := db.Collection("VerifyContractModel")
+	if collection.FindOne(ctx, bson.M{"hash": contract, "updatecounter": counter}).Err() == nil {
+		return nil
+	}
+	//只匹配直接验证过的记录，避免similar记录之间互相引用，Partial记录不向其它合约传播
+	var original insertVerifiedContract
+	filter := bson.M{"scripthash": hash, "status": bson.M{"$ne": statusSimilar}, "level": bson.M{"$ne": levelPartial}, "similarto": bson.M{"$exists": false}}
+	err = collection.FindOne(ctx, filter, options.FindOne().SetSort(bson.M{"_id": 1})).Decode(&original)
+	if err != nil {
+		return nil
+	}
+	level := original.Level
+	chainManifest := gjson.GetBytes(body, "result.manifest").Raw
+	if original.ManifestHash != manifestHash(chainManifest) {
+		//与已验证合约的manifest逐字段比对，只有extra等不影响执行的差异时记为Script，否则不是相同的合约
+		verified, err := verifiedManifest(ctx, db, original)
+		if err != nil {
+			fmt.Println("Watcher: manifest of verified contract", original.Hash, "isn't available:", err)
+			return nil
+		}
+		var a, b manifest.Manifest
+		if json.Unmarshal([]byte(verified), &a) != nil || json.Unmarshal([]byte(chainManifest), &b) != nil {
+			return nil
+		}
+		manifestLevel := verificationLevel("", "", compareManifest(&a, &b), nefReport{})
+		if manifestLevel == "" {
+			return nil
+		}
+		if manifestLevel == levelScript {
+			level = levelScript
+		}
+	}
+	from := original.Updatecounter
+	similar := insertVerifiedContract{
+		Hash:           contract,
+		Id:             id,
+		Updatecounter:  counter,
+		Level:          level,
+		Status:         statusSimilar,
+		NefHash:        nefHash(gjson.GetBytes(body, "result.nef").Raw),
+		ManifestHash:   manifestHash(gjson.GetBytes(body, "result.manifest").Raw),
+		ScriptHash:     hash,
+		SimilarTo:      original.Hash,
+		SimilarCounter: &from,
+	}
+	_, err = collection.InsertOne(ctx, similar)
+	if err != nil {
+		return err
+	}
+	fmt.Println("Watcher: contract", contract, "is a similar match of verified contract", original.Hash, "update counter", from)
+	return nil
+}
+
+// 返回已验证合约在验证时的链上manifest，合约之后更新过时从部署或更新交易中获取，hash与验证记录不一致时返回错误
+func verifiedManifest(ctx context.Context, db *mongo.Database, original insertVerifiedContract) (string, error) {
+	body, err := rpcCall("getcontractstate", []interface{}{original.Hash})
+	if err != nil {
+		return "", err
+	}
+	current := gjson.GetBytes(body, "result.manifest").Raw
+	if manifestHash(current) == original.ManifestHash {
+		return current, nil
+	}
+	state, err := historicalState(ctx, db, original.Hash, original.Updatecounter, int(gjson.GetBytes(body, "result.updatecounter").Int()))
+	if err != nil {
+		return "", err
+	}
+	if manifestHash(state.Manifest) != original.ManifestHash {
+		return "", errors.New("manifest doesn't match the verification record")
+	}
+	return state.Manifest, nil
+}
@@ -0,0 +1,453 @@
+package main
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// 定义按需安装的编译器工具链，Archive为工具链压缩包（.tar.gz、.tgz或.zip）的文件名，
+// Sha256为压缩包的hash，Setup为解压之后在安装目录中执行的命令，例如用压缩包中的wheel创建python虚拟环境
+type toolchainConfig struct {
+	Archive string   `yaml:"archive"`
+	Sha256  string   `yaml:"sha256"`
+	Setup   []string `yaml:"setup"`
+}
+
+// 编译命令中的占位符，加载配置时替换成工具链的安装目录
+const toolchainPlaceholder = "{toolchain}"
+
+// 安装完成之后写入安装目录的标记文件，内容为压缩包的hash，没有标记文件的目录视为未安装完成
+const toolchainMarker = ".toolchain"
+
+// 同一个工具链同时只进行一次安装
+var toolchainLocks sync.Map
+
+// 工具链的安装目录，可以通过TOOLCHAIN_DIR环境变量指定
+func toolchainDir() string {
+	if d := os.Getenv("TOOLCHAIN_DIR"); d != "" {
+		return d
+	}
+	return "/go/application/toolchains"
+}
+
+// 工具链压缩包所在的本地目录，可以通过TOOLCHAIN_ARTIFACTS环境变量指定
+func toolchainArtifacts() string {
+	if d := os.Getenv("TOOLCHAIN_ARTIFACTS"); d != "" {
+		return d
+	}
+	return "/go/application/artifacts"
+}
+
+// 下载和安装工具链的超时时间，可以通过TOOLCHAIN_TIMEOUT环境变量指定（秒）
+func toolchainTimeout() time.Duration {
+	return time.Duration(getEnvInt("TOOLCHAIN_TIMEOUT", 600)) * time.Second
+}
+
+// 工具链的安装目录按编译器名称和版本区分
+func toolchainPath(c compilerConfig) string {
+	dir, _ := filepath.Abs(toolchainDir())
+	return filepath.Join(dir, strings.ReplaceAll(c.Name, "/", "_"), c.Version)
+}
+
+// 检查工具链是否已经安装，并且安装的压缩包与配置中的hash一致
+func toolchainInstalled(c compilerConfig) bool {
+	data, err := ioutil.ReadFile(filepath.Join(toolchainPath(c), toolchainMarker))
+	return err == nil && strings.TrimSpace(string(data)) == c.Toolchain.Sha256
+}
+
+// 安装编译器的工具链，已经安装时直接返回。安装时持有该工具链的锁，下载和setup都有超时时间
+func installToolchain(ctx context.Context, c compilerConfig) error {
+	if c.Toolchain == nil {
+		return nil
+	}
+	lock, _ := toolchainLocks.LoadOrStore(c.ID, &sync.Mutex{})
+	lock.(*sync.Mutex).Lock()
+	defer lock.(*sync.Mutex).Unlock()
+	if toolchainInstalled(c) {
+		return nil
+	}
+	ctx, cancel := context.WithTimeout(ctx, toolchainTimeout())
+	defer cancel()
+	dst := toolchainPath(c)
+	fmt.Println("Toolchain: installing " + c.ID + " into " + dst)
+	err := os.MkdirAll(filepath.Dir(dst), 0777)
+	if err != nil {
+		return err
+	}
+	//先解压到临时目录，再移动到安装目录，避免留下解压了一半的工具链
+	tmp, err := ioutil.TempDir(filepath.Dir(dst), ".install-")
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(tmp)
+	archive, err := fetchToolchain(ctx, c.Toolchain)
+	if err != nil {
+		return err
+	}
+	defer os.Remove(archive)
+	err = unpackToolchain(archive, c.Toolchain.Archive, tmp)
+	if err != nil {
+		return err
+	}
+	err = os.RemoveAll(dst)
+	if err != nil {
+		return err
+	}
+	err = os.Rename(tmp, dst)
+	if err != nil {
+		return err
+	}
+	err = os.Chmod(dst, 0755)
+	if err != nil {
+		return err
+	}
+	//虚拟环境等包含绝对路径的工具链需要在最终的安装目录中初始化
+	if len(c.Toolchain.Setup) > 0 {
+		args := []string{}
+		for _, a := range c.Toolchain.Setup {
+			args = append(args, strings.ReplaceAll(a, toolchainPlaceholder, dst))
+		}
+		cmd := exec.Command(args[0], args[1:]...)
+		cmd.Dir = dst
+		//配置了本地镜像时，setup中安装的依赖（例如pip）也只从镜像获取
+		err = mirrors.apply(cmd, c.Language)
+		if err != nil {
+			os.RemoveAll(dst)
+			return err
+		}
+		out, err := runSetup(ctx, cmd)
+		if err != nil {
+			os.RemoveAll(dst)
+			return fmt.Errorf("toolchain %s: setup failed: %v\n%s", c.ID, err, out)
+		}
+	}
+	return ioutil.WriteFile(filepath.Join(dst, toolchainMarker), []byte(c.Toolchain.Sha256+"\n"), 0666)
+}
+
+// 执行setup命令，ctx结束时结束整个进程组，避免pip等遗留的子进程占用输出管道
+func runSetup(ctx context.Context, cmd *exec.Cmd) ([]byte, error) {
+	var out bytes.Buffer
+	cmd.Stdout = &out
+	cmd.Stderr = &out
+	cmd.SysProcAttr = &syscall.SysProcAttr{Setpgid: true}
+	err := cmd.Start()
+	if err != nil {
+		return nil, err
+	}
+	done := make(chan struct{})
+	go func() {
+		select {
+		case <-ctx.Done():
+			syscall.Kill(-cmd.Process.Pid, syscall.SIGKILL)
+		case <-done:
+		}
+	}()
+	err = cmd.Wait()
+	close(done)
+	if err != nil && ctx.Err() != nil {
+		err = fmt.Errorf("%v (%v)", err, ctx.Err())
+	}
+	return out.Bytes(), err
+}
+
+// 从本地目录或TOOLCHAIN_MIRROR指定的镜像地址获取压缩包，检查hash之后返回临时文件的路径
+func fetchToolchain(ctx context.Context, t *toolchainConfig) (string, error) {
+	var src io.ReadCloser
+	f, err := os.Open(filepath.Join(toolchainArtifacts(), t.Archive))
+	if err == nil {
+		src = f
+	} else if mirror := os.Getenv("TOOLCHAIN_MIRROR"); mirror != "" {
+		req, err := http.NewRequestWithContext(ctx, http.MethodGet, strings.TrimSuffix(mirror, "/")+"/"+t.Archive, nil)
+		if err != nil {
+			return "", err
+		}
+		client := &http.Client{Timeout: toolchainTimeout()}
+		resp, err := client.Do(req)
+		if err != nil {
+			return "", err
+		}
+		if resp.StatusCode != http.StatusOK {
+			resp.Body.Close()
+			return "", fmt.Errorf("download %s: %s", t.Archive, resp.Status)
+		}
+		src = resp.Body
+	} else {
+		return "", errors.New("toolchain archive " + t.Archive + " isn't in " + toolchainArtifacts() + " and TOOLCHAIN_MIRROR isn't set")
+	}
+	defer src.Close()
+	tmp, err := ioutil.TempFile("", "toolchain-")
+	if err != nil {
+		return "", err
+	}
+	defer tmp.Close()
+	_, err = io.Copy(tmp, src)
+	if err != nil {
+		os.Remove(tmp.Name())
+		return "", err
+	}
+	sum, err := fileSha256(tmp.Name())
+	if err != nil {
+		os.Remove(tmp.Name())
+		return "", err
+	}
+	if sum != t.Sha256 {
+		os.Remove(tmp.Name())
+		return "", fmt.Errorf("toolchain archive %s: hash is %s, expected %s", t.Archive, sum, t.Sha256)
+	}
+	return tmp.Name(), nil
+}
+
+// 按压缩包的后缀解压到dst
+func unpackToolchain(archive string, name string, dst string) error {
+	switch {
+	case strings.HasSuffix(name, ".tar.gz") || strings.HasSuffix(name, ".tgz"):
+		return untar(archive, dst)
+	case strings.HasSuffix(name, ".zip"):
+		return unzip(archive, dst)
+	}
+	return errors.New("unsupported toolchain archive " + name + ", please use .tar.gz, .tgz or .zip")
+}
+
+// 返回压缩包中的文件解压之后的路径，不允许解压到dst之外
+func unpackPath(dst string, name string) (string, error) {
+	p := filepath.Join(dst, filepath.FromSlash(name))
+	if p != dst && !strings.HasPrefix(p, dst+string(filepath.Separator)) {
+		return "", errors.New("invalid path " + name + " in toolchain archive")
+	}
+	return p, nil
+}
+
+func untar(archive string, dst string) error {
+	f, err := os.Open(archive)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	gz, err := gzip.NewReader(f)
+	if err != nil {
+		return err
+	}
+	r := tar.NewReader(gz)
+	for {
+		h, err := r.Next()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		p, err := unpackPath(dst, h.Name)
+		if err != nil {
+			return err
+		}
+		switch h.Typeflag {
+		case tar.TypeDir:
+			err = os.MkdirAll(p, 0777)
+		case tar.TypeReg:
+			err = writeUnpackedFile(p, r, os.FileMode(h.Mode).Perm())
+		case tar.TypeSymlink:
+			//只允许指向工具链内部的相对链接
+			_, err = unpackPath(dst, filepath.Join(filepath.Dir(h.Name), h.Linkname))
+			if err == nil && filepath.IsAbs(h.Linkname) {
+				err = errors.New("invalid link " + h.Name + " in toolchain archive")
+			}
+			if err == nil {
+				err = os.MkdirAll(filepath.Dir(p), 0777)
+			}
+			if err == nil {
+				err = os.Symlink(h.Linkname, p)
+			}
+		}
+		if err != nil {
+			return err
+		}
+	}
+}
+
+func unzip(archive string, dst string) error {
+	r, err := zip.OpenReader(archive)
+	if err != nil {
+		return err
+	}
+	defer r.Close()
+	for _, f := range r.File {
+		p, err := unpackPath(dst, f.Name)
+		if err != nil {
+			return err
+		}
+		if f.FileInfo().IsDir() {
+			err = os.MkdirAll(p, 0777)
+			if err != nil {
+				return err
+			}
+			continue
+		}
+		src, err := f.Open()
+		if err != nil {
+			return err
+		}
+		err = writeUnpackedFile(p, src, f.Mode().Perm())
+		src.Close()
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func writeUnpackedFile(p string, src io.Reader, mode os.FileMode) error {
+	err := os.MkdirAll(filepath.Dir(p), 0777)
+	if err != nil {
+		return err
+	}
+	out, err := os.OpenFile(p, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, mode|0600)
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(out, src)
+	if err != nil {
+		out.Close()
+		return err
+	}
+	return out.Close()
+}
+
+// 删除注册表中不再使用的工具链、hash与配置不一致的工具链以及没有安装完成的目录。
+// 正在安装的目录（.install-*临时目录以及还没有写入标记文件的安装目录）可能属于其它进程，
+// 只有超过TOOLCHAIN_TIMEOUT没有修改时才视为安装失败遗留的目录
+func pruneToolchains(registry *compilerRegistry) ([]string, error) {
+	dir, _ := filepath.Abs(toolchainDir())
+	keep := map[string]bool{}
+	for _, c := range registry.all() {
+		cfg := c.Config()
+		if cfg.Toolchain != nil && toolchainInstalled(cfg) {
+			keep[toolchainPath(cfg)] = true
+		}
+	}
+	removed := []string{}
+	names, err := ioutil.ReadDir(dir)
+	if os.IsNotExist(err) {
+		return removed, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	for _, name := range names {
+		p := filepath.Join(dir, name.Name())
+		if !name.IsDir() {
+			continue
+		}
+		versions, err := ioutil.ReadDir(p)
+		if err != nil {
+			return nil, err
+		}
+		for _, v := range versions {
+			if toolchainInProgress(filepath.Join(p, v.Name()), v) {
+				continue
+			}
+			if !keep[filepath.Join(p, v.Name())] {
+				removed = append(removed, filepath.Join(p, v.Name()))
+			}
+		}
+	}
+	for _, p := range removed {
+		err = os.RemoveAll(p)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return removed, nil
+}
+
+// 判断目录是否可能正在安装：没有标记文件，并且在安装超时时间之内修改过
+func toolchainInProgress(p string, info os.FileInfo) bool {
+	if _, err := os.Stat(filepath.Join(p, toolchainMarker)); err == nil {
+		return false
+	}
+	return time.Since(info.ModTime()) < toolchainTimeout()
+}
+
+// 管理编译器工具链的命令：
+//
+//	toolchain list
+//	toolchain install [<compiler id>...]
+//	toolchain prune
+func toolchainCommand(args []string) int {
+	registry, err := loadCompilerRegistry(compilersConfigFile())
+	if err != nil {
+		fmt.Println(err)
+		return 1
+	}
+	mirrors, err = loadMirrors(mirrorDir())
+	if err != nil {
+		fmt.Println(err)
+		return 1
+	}
+	if len(args) == 1 && args[0] == "list" {
+		for _, c := range registry.all() {
+			cfg := c.Config()
+			if cfg.Toolchain == nil {
+				fmt.Println(c.ID() + "\tbuilt-in")
+			} else if toolchainInstalled(cfg) {
+				fmt.Println(c.ID() + "\tinstalled\t" + toolchainPath(cfg))
+			} else {
+				fmt.Println(c.ID() + "\tnot installed\t" + cfg.Toolchain.Archive)
+			}
+		}
+		return 0
+	}
+	if len(args) >= 1 && args[0] == "install" {
+		targets := registry.all()
+		if len(args) > 1 {
+			targets = nil
+			for _, id := range args[1:] {
+				c, err := registry.lookup(id)
+				if err != nil {
+					fmt.Println(err)
+					return 1
+				}
+				targets = append(targets, c)
+			}
+		}
+		for _, c := range targets {
+			if c.Config().Toolchain == nil {
+				continue
+			}
+			err = installToolchain(context.Background(), c.Config())
+			if err != nil {
+				fmt.Println(err)
+				return 1
+			}
+			fmt.Println(c.ID() + "\tinstalled\t" + toolchainPath(c.Config()))
+		}
+		return 0
+	}
+	if len(args) == 1 && args[0] == "prune" {
+		removed, err := pruneToolchains(registry)
+		if err != nil {
+			fmt.Println(err)
+			return 1
+		}
+		for _, p := range removed {
+			fmt.Println("removed " + p)
+		}
+		return 0
+	}
+	fmt.Println("usage: toolchain list | toolchain install [<compiler id>...] | toolchain prune")
+	return 2
+}
@@ -0,0 +1,65 @@
+package main
+
+import (
+	"errors"
+	"mime"
+	"mime/multipart"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+)
+
+// 编译生成的目录，复制和保存源代码时跳过
+var outputDirs = map[string]bool{"bin": true, "obj": true, "neow3j": true, "__pycache__": true, compileLogDir: true}
+
+// 返回上传文件相对于上传目录的路径，保留客户端提供的目录结构，不允许绝对路径和..
+func uploadFileName(part *multipart.Part) (string, error) {
+	name := part.FileName()
+	//FileName()在新版本的Go中只返回文件名，从Content-Disposition中取出完整的路径
+	_, params, err := mime.ParseMediaType(part.Header.Get("Content-Disposition"))
+	if err == nil && params["filename"] != "" {
+		name = params["filename"]
+	}
+	name = strings.ReplaceAll(name, "\\", "/")
+	if strings.HasPrefix(name, "/") {
+		return "", errors.New("invalid file name " + name)
+	}
+	name = path.Clean(name)
+	if name == "." || name == ".." || strings.HasPrefix(name, "../") {
+		return "", errors.New("invalid file name " + name)
+	}
+	return name, nil
+}
+
+// 创建上传文件，需要时创建所在的子目录
+func createUploadFile(pathFile string, name string) (*os.File, error) {
+	err := os.MkdirAll(filepath.Dir(pathFile+"/"+name), 0777)
+	if err != nil {
+		return nil, err
+	}
+	return os.OpenFile(pathFile+"/"+name, os.O_WRONLY|os.O_CREATE, 0666)
+}
+
+// 返回上传目录中的所有文件（相对路径），跳过编译生成的目录
+func walkSources(pathFile string) ([]string, error) {
+	files := []string{}
+	err := filepath.Walk(pathFile, func(p string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if info.IsDir() {
+			if p != pathFile && outputDirs[info.Name()] {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		rel, err := filepath.Rel(pathFile, p)
+		if err != nil {
+			return err
+		}
+		files = append(files, filepath.ToSlash(rel))
+		return nil
+	})
+	return files, err
+}
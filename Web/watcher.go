@@ -0,0 +1,360 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/nspcc-dev/neo-go/pkg/smartcontract/manifest"
+	"github.com/nspcc-dev/neo-go/pkg/smartcontract/nef"
+	"github.com/nspcc-dev/neo-go/pkg/util"
+	"github.com/tidwall/gjson"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+	"os"
+	"strconv"
+	"time"
+)
+
+// 验证记录的状态
+const (
+	statusVerified = "verified"
+	//script只有嵌入的元数据不同，不能视为已验证
+	statusPartial   = "partial"
+	statusStale     = "stale"
+	statusDestroyed = "destroyed"
+	statusCarried   = "carried"
+)
+
+// 计算nef的sha256，参数为getcontractstate返回的nef json
+func nefHash(nefJSON string) string {
+	var f nef.File
+	err := json.Unmarshal([]byte(nefJSON), &f)
+	if err != nil {
+		return ""
+	}
+	b, err := f.Bytes()
+	if err != nil {
+		return ""
+	}
+	h := sha256.Sum256(b)
+	return hex.EncodeToString(h[:])
+}
+
+// 计算manifest的sha256，manifest先反序列化再序列化，消除格式上的差异
+func manifestHash(manifestJSON string) string {
+	var m manifest.Manifest
+	err := json.Unmarshal([]byte(manifestJSON), &m)
+	if err != nil {
+		return ""
+	}
+	b, err := json.Marshal(&m)
+	if err != nil {
+		return ""
+	}
+	h := sha256.Sum256(b)
+	return hex.EncodeToString(h[:])
+}
+
+// 后台轮询新区块，发现已验证合约的Update或Destroy通知时更新验证记录。
+// 数据库不可用时不退出，等待之后重新连接；节点请求与其它代码一样使用rpcCall，
+// neo-go的rpc/client依赖的gorilla/websocket等模块不在go.sum中，并且需要先请求getversion初始化
+func watchContracts() {
+	if os.Getenv("WATCHER") == "off" {
+		return
+	}
+	cfg, err := OpenConfigFile()
+	if err != nil {
+		fmt.Println("Watcher: open config file error", err)
+		return
+	}
+	ctx := context.TODO()
+	interval := time.Duration(getEnvInt("WATCH_INTERVAL", 15)) * time.Second
+	var db *mongo.Database
+	for db == nil {
+		co, dbonline, err := connectMongo(cfg, ctx)
+		if err != nil {
+			fmt.Println("Watcher:", err)
+			time.Sleep(interval)
+			continue
+		}
+		db = co.Database(dbonline)
+	}
+	err = ensureScriptHashIndex(ctx, db)
+	if err != nil {
+		fmt.Println("Watcher: create script hash index error", err)
+	}
+	err = ensureContractEventIndex(ctx, db)
+	if err != nil {
+		fmt.Println("Watcher: create contract event index error", err)
+	}
+	fmt.Println("Watcher start")
+	for {
+		//连接之后数据库暂时不可用时，mongo驱动会自动重连，这一轮的错误在下一轮重试
+		err := watchNewBlocks(ctx, db)
+		if err != nil {
+			fmt.Println("Watcher:", err)
+		}
+		time.Sleep(interval)
+	}
+}
+
+// 第一次启动时开始处理的高度，没有设置WATCH_START_HEIGHT时从当前高度开始，
+// 验证历史版本需要的之前区块中的通知通过 ./main watcher backfill 补充
+func watchStartHeight(count int) int {
+	h, err := strconv.Atoi(os.Getenv("WATCH_START_HEIGHT"))
+	if err != nil || h < 0 {
+		return count
+	}
+	return h
+}
+
+// 处理上次处理的高度之后的所有区块，处理进度保存在VerifyContractWatcher表中
+func watchNewBlocks(ctx context.Context, db *mongo.Database) error {
+	body, err := rpcCall("getblockcount", []interface{}{})
+	if err != nil {
+		return err
+	}
+	count := int(gjson.GetBytes(body, "result").Int())
+	if count == 0 {
+		return errors.New("failed to get block count")
+	}
+	var progress struct {
+		Height int
+	}
+	err = db.Collection("VerifyContractWatcher").FindOne(ctx, bson.M{"name": "watcher"}).Decode(&progress)
+	if err != nil {
+		progress.Height = watchStartHeight(count) - 1
+	}
+	for height := progress.Height + 1; height < count; height++ {
+		err = watchBlock(ctx, db, height, true)
+		if err != nil {
+			return err
+		}
+		_, err = db.Collection("VerifyContractWatcher").UpdateOne(ctx, bson.M{"name": "watcher"},
+			bson.M{"$set": bson.M{"name": "watcher", "height": height}}, options.Update().SetUpsert(true))
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// 检查区块中所有交易的ContractManagement通知，记录所有合约的Deploy、Update和Destroy通知，
+// handle为true时同时更新验证记录，补充历史区块时只记录通知
+func watchBlock(ctx context.Context, db *mongo.Database, height int, handle bool) error {
+	body, err := rpcCall("getblock", []interface{}{height, true})
+	if err != nil {
+		return err
+	}
+	if gjson.GetBytes(body, "error").Exists() {
+		return errors.New(gjson.GetBytes(body, "error.message").String())
+	}
+	for i, tx := range gjson.GetBytes(body, "result.tx").Array() {
+		txHash := tx.Get("hash").String()
+		log, err := rpcCall("getapplicationlog", []interface{}{txHash})
+		if err != nil {
+			return err
+		}
+		index := 0
+		for _, execution := range gjson.GetBytes(log, "result.executions").Array() {
+			if execution.Get("vmstate").String() != "HALT" {
+				continue
+			}
+			for _, n := range execution.Get("notifications").Array() {
+				index++
+				if n.Get("contract").String() != contractManagementHash {
+					continue
+				}
+				event := n.Get("eventname").String()
+				if event != "Deploy" && event != "Update" && event != "Destroy" {
+					continue
+				}
+				hash, err := base64.StdEncoding.DecodeString(n.Get("state.value.0.value").String())
+				if err != nil {
+					continue
+				}
+				u, err := util.Uint160DecodeBytesBE(hash)
+				if err != nil {
+					continue
+				}
+				contract := "0x" + u.StringLE()
+				err = saveContractEvent(ctx, db, contractEvent{contract, event, txHash, height, i, index})
+				if err != nil {
+					return err
+				}
+				if !handle {
+					continue
+				}
+				err = handleContractEvent(ctx, db, contract, event, txHash)
+				if err != nil {
+					return err
+				}
+			}
+		}
+	}
+	return nil
+}
+
+// 合约被销毁时把验证记录标记为destroyed，被更新时标记为stale，
+// 如果更新前后nef和manifest完全一致，为新的更新次数生成一条carried记录，
+// 否则检查新的字节码是否与其它已验证合约一致
+func handleContractEvent(ctx context.Context, db *mongo.Database, contract string, event string, txHash string) error {
+	if event == "Deploy" {
+		return similarMatch(ctx, db, contract)
+	}
+	err := carryForward(ctx, db, contract, event, txHash)
+	if err != nil || event == "Destroy" {
+		return err
+	}
+	return similarMatch(ctx, db, contract)
+}
+
+func carryForward(ctx context.Context, db *mongo.Database, contract string, event string, txHash string) error {
+	collection := db.Collection("VerifyContractModel")
+	var records []insertVerifiedContract
+	cursor, err := collection.Find(ctx, bson.M{"hash": contract}, options.Find().SetSort(bson.M{"updatecounter": -1}))
+	if err != nil {
+		return err
+	}
+	err = cursor.All(ctx, &records)
+	if err != nil {
+		return err
+	}
+	if len(records) == 0 {
+		return nil
+	}
+	fmt.Println("Watcher: " + event + " of verified contract " + contract + " in transaction " + txHash)
+	if event == "Destroy" {
+		_, err = collection.UpdateMany(ctx, bson.M{"hash": contract}, bson.M{"$set": bson.M{"status": statusDestroyed}})
+		return err
+	}
+	//更新之后的nef和manifest与当前链上状态一致时才能确定新的更新次数
+	body, err := rpcCall("getcontractstate", []interface{}{contract})
+	if err != nil {
+		return err
+	}
+	if gjson.GetBytes(body, "error").Exists() {
+		return errors.New(gjson.GetBytes(body, "error.message").String())
+	}
+	counter := int(gjson.GetBytes(body, "result.updatecounter").Int())
+	//只把当前版本之前的记录标记为stale，处理较早的区块时不会影响已经验证的当前版本；
+	//漏掉了某次更新（更新次数跳过了中间的值）时之前的记录同样都标记为stale，但不会沿用到当前版本
+	_, err = collection.UpdateMany(ctx, bson.M{"hash": contract, "updatecounter": bson.M{"$lt": counter}}, bson.M{"$set": bson.M{"status": statusStale}})
+	if err != nil {
+		return err
+	}
+	newNef := nefHash(gjson.GetBytes(body, "result.nef").Raw)
+	newManifest := manifestHash(gjson.GetBytes(body, "result.manifest").Raw)
+	//只有该交易是按链上顺序的第counter次更新时，才能用交易中的nef和manifest确认更新之后的状态
+	tx, err := findVersionTransaction(ctx, db, contract, counter)
+	if err != nil || tx != txHash {
+		return nil
+	}
+	updated, err := stateFromTransaction(contract, txHash, counter)
+	if err != nil || nefHash(updated.Nef) != newNef || manifestHash(updated.Manifest) != newManifest {
+		return nil
+	}
+	previous := records[0]
+	if previous.Updatecounter != counter-1 || previous.Level == levelPartial || previous.NefHash == "" || previous.NefHash != newNef || previous.ManifestHash != newManifest {
+		return nil
+	}
+	//先复制源代码记录，最后插入验证记录，中途失败时区块会被重新处理，源代码按文件名覆盖，不会重复
+	from := previous.Updatecounter
+	var sources []insertContractSourceCode
+	cursor, err = db.Collection("ContractSourceCode").Find(ctx, bson.M{"hash": contract, "updatecounter": from})
+	if err != nil {
+		return err
+	}
+	err = cursor.All(ctx, &sources)
+	if err != nil {
+		return err
+	}
+	for _, source := range sources {
+		source.Updatecounter = counter
+		filter := bson.M{"hash": contract, "updatecounter": counter, "filename": source.FileName}
+		_, err = db.Collection("ContractSourceCode").ReplaceOne(ctx, filter, source, options.Replace().SetUpsert(true))
+		if err != nil {
+			return err
+		}
+	}
+	carried := previous
+	carried.Updatecounter = counter
+	carried.Status = statusCarried
+	carried.CarriedFrom = &from
+	_, err = collection.InsertOne(ctx, carried)
+	if err != nil {
+		return err
+	}
+	fmt.Println("Watcher: carried verification of", contract, "forward from update counter", from, "to", counter)
+	return nil
+}
+
+// 补充记录历史区块中通知的命令，watcher第一次启动之前的区块需要补充之后才能验证其中部署或更新的合约的历史版本：
+//
+//	watcher backfill <from height> [<to height>]
+//
+// 没有指定结束高度时处理到watcher第一次启动时的高度为止，已经记录的通知不会重复插入
+func watcherCommand(args []string) int {
+	if len(args) < 2 || len(args) > 3 || args[0] != "backfill" {
+		fmt.Println("usage: watcher backfill <from height> [<to height>]")
+		return 2
+	}
+	from, err := strconv.Atoi(args[1])
+	if err != nil || from < 0 {
+		fmt.Println("invalid height " + args[1])
+		return 2
+	}
+	cfg, err := OpenConfigFile()
+	if err != nil {
+		fmt.Println(err)
+		return 1
+	}
+	ctx := context.TODO()
+	co, dbonline, err := connectMongo(cfg, ctx)
+	if err != nil {
+		fmt.Println(err)
+		return 1
+	}
+	defer co.Disconnect(ctx)
+	db := co.Database(dbonline)
+	err = ensureContractEventIndex(ctx, db)
+	if err != nil {
+		fmt.Println(err)
+		return 1
+	}
+	to := 0
+	if len(args) == 3 {
+		to, err = strconv.Atoi(args[2])
+		if err != nil {
+			fmt.Println("invalid height " + args[2])
+			return 2
+		}
+	} else {
+		var progress struct {
+			Height int
+		}
+		err = db.Collection("VerifyContractWatcher").FindOne(ctx, bson.M{"name": "watcher"}).Decode(&progress)
+		if err != nil {
+			fmt.Println("the watcher hasn't started yet, please specify the end height")
+			return 1
+		}
+		to = progress.Height + 1
+	}
+	for height := from; height < to; height++ {
+		err = watchBlock(ctx, db, height, false)
+		if err != nil {
+			fmt.Println("block", height, err)
+			return 1
+		}
+		if (height-from)%1000 == 999 {
+			fmt.Println("backfilled up to block", height)
+		}
+	}
+	fmt.Println("backfilled blocks", from, "to", to-1)
+	return 0
+}